@@ -6,5 +6,13 @@ require (
 	github.com/aws/aws-sdk-go v1.36.32
 	github.com/discord/lilliput v0.0.0-20210107074859-dbb0328436e8
 	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/tdewolff/minify/v2 v2.9.11
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 )
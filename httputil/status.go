@@ -0,0 +1,33 @@
+package httputil
+
+import "net/http"
+
+// ResponseWriter keeping the status written by the handlers, for the middlewares reporting it
+type StatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w}
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Status written so far, a handler which wrote nothing answered 200
+func (w *StatusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,301 @@
+package journal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+const (
+	entryExtension = ".json"
+	dataExtension  = ".data"
+	tmpExtension   = ".tmp"
+)
+
+var (
+	ErrNotFound  = errors.New("job not found")
+	ErrInvalidID = errors.New("invalid job id")
+)
+
+type Entry struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"` // which processor runs the job, e.g. image or audio
+	Status string `json:"status"`
+
+	// Processor options of the job, as marshalled by the router
+	Options json.RawMessage `json:"options,omitempty"`
+	// Preset picked by the client, reported along with the result
+	Preset string `json:"preset,omitempty"`
+
+	// Principal the job belongs to, only the owner can read the job status
+	Owner         string `json:"owner,omitempty"`
+	TenantID      string `json:"tenant_id,omitempty"`
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+
+	// Scheduling of the job in the processor queue
+	Priority int    `json:"priority"`
+	FairKey  string `json:"fair_key,omitempty"`
+
+	// Storage path of the result once done, error message once failed
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Metadata of the result once done, as marshalled by the router
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/*
+Durable job queue kept in a local directory, one json file per job and one
+file holding its raw input while the job is pending. Every write goes through
+a synced temp file renamed into place, so a crash leaves either the old or the
+new version of a file, never a torn one.
+The input is written before the entry, an entry on disk always has its input.
+*/
+type Journal struct {
+	Dir string
+
+	mutex sync.Mutex
+}
+
+func NewJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	return &Journal{Dir: dir}, nil
+}
+
+func newID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Ids are generated by the journal, anything else could escape the directory
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (j *Journal) path(id, extension string) string {
+	return filepath.Join(j.Dir, id+extension)
+}
+
+func writeFileSync(name string, data []byte) error {
+	tmp := name + tmpExtension
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (j *Journal) writeEntry(entry *Entry) error {
+	entry.UpdatedAt = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(j.path(entry.ID, entryExtension), data)
+}
+
+func (j *Journal) readEntry(id string) (*Entry, error) {
+	data, err := ioutil.ReadFile(j.path(id, entryExtension))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("journal: %s: %v", id, err)
+	}
+	return &entry, nil
+}
+
+// Persist a pending job and its input, the id and dates of entry are set by the journal
+func (j *Journal) Append(entry Entry, data []byte) (*Entry, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	entry.ID = id
+	entry.Status = StatusPending
+	entry.CreatedAt = time.Now()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err = writeFileSync(j.path(id, dataExtension), data); err != nil {
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	if err = j.writeEntry(&entry); err != nil {
+		os.Remove(j.path(id, dataExtension))
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	return &entry, nil
+}
+
+func (j *Journal) Get(id string) (*Entry, error) {
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.readEntry(id)
+}
+
+// Raw input of a pending job
+func (j *Journal) Data(id string) ([]byte, error) {
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+	data, err := ioutil.ReadFile(j.path(id, dataExtension))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Close the job, its input is dropped once the new status is on disk
+func (j *Journal) finish(id string, update func(entry *Entry)) error {
+	if !validID(id) {
+		return ErrInvalidID
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry, err := j.readEntry(id)
+	if err != nil {
+		return err
+	}
+	update(entry)
+	if err = j.writeEntry(entry); err != nil {
+		return fmt.Errorf("journal: %v", err)
+	}
+	if err = os.Remove(j.path(id, dataExtension)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("journal: %v", err)
+	}
+	return nil
+}
+
+// Mark the job done, to be called once its result is saved
+func (j *Journal) Done(id, path string, metadata json.RawMessage) error {
+	return j.finish(id, func(entry *Entry) {
+		entry.Status = StatusDone
+		entry.Path = path
+		entry.Metadata = metadata
+	})
+}
+
+// Mark the job failed for good, it won't be replayed
+func (j *Journal) Fail(id string, cause error) error {
+	return j.finish(id, func(entry *Entry) {
+		entry.Status = StatusFailed
+		entry.Error = cause.Error()
+	})
+}
+
+// Walk every entry, broken ones are skipped
+func (j *Journal) entries() ([]*Entry, error) {
+	files, err := ioutil.ReadDir(j.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %v", err)
+	}
+	var entries []*Entry
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), entryExtension)
+		if !strings.HasSuffix(file.Name(), entryExtension) || !validID(id) {
+			continue
+		}
+		entry, err := j.readEntry(id)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Pending jobs of a kind, oldest first
+func (j *Journal) Pending(kind string) ([]*Entry, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entries, err := j.entries()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Entry
+	for _, entry := range entries {
+		if entry.Status == StatusPending && entry.Kind == kind {
+			pending = append(pending, entry)
+		}
+	}
+	sort.Slice(pending, func(a, b int) bool {
+		return pending[a].CreatedAt.Before(pending[b].CreatedAt)
+	})
+	return pending, nil
+}
+
+/*
+Remove the done and failed jobs older than maxAge, along with the files left
+over by a crash: temp files and inputs whose entry was never written.
+*/
+func (j *Journal) Prune(maxAge time.Duration) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	files, err := ioutil.ReadDir(j.Dir)
+	if err != nil {
+		return fmt.Errorf("journal: %v", err)
+	}
+	now := time.Now()
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, tmpExtension):
+			os.Remove(filepath.Join(j.Dir, name))
+		case strings.HasSuffix(name, dataExtension):
+			id := strings.TrimSuffix(name, dataExtension)
+			if _, err := os.Stat(j.path(id, entryExtension)); os.IsNotExist(err) {
+				os.Remove(filepath.Join(j.Dir, name))
+			}
+		case strings.HasSuffix(name, entryExtension):
+			entry, err := j.readEntry(strings.TrimSuffix(name, entryExtension))
+			if err != nil || entry.Status == StatusPending || now.Sub(entry.UpdatedAt) < maxAge {
+				continue
+			}
+			os.Remove(filepath.Join(j.Dir, name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package journal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := j.Append(Entry{Kind: "image", Options: []byte(`{"ImageType":"png"}`)}, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := j.Append(Entry{Kind: "image"}, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := j.Append(Entry{Kind: "image"}, []byte("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Append(Entry{Kind: "audio"}, []byte("audio")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = j.Done(done.ID, "result/path", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Fail(failed.ID, errors.New("broken input")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Data(done.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("input of a done job should be dropped, got %v", err)
+	}
+
+	// a restarted process only sees what is on disk
+	reopened, err := NewJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.Pending("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != pending.ID {
+		t.Fatalf("expected only the pending image job, got %v", entries)
+	}
+	data, err := reopened.Data(pending.ID)
+	if err != nil || string(data) != "third" {
+		t.Fatalf("unexpected input %q: %v", data, err)
+	}
+
+	entry, err := reopened.Get(done.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != StatusDone || entry.Path != "result/path" || string(entry.Options) != `{"ImageType":"png"}` {
+		t.Fatalf("unexpected done entry %+v", entry)
+	}
+	if entry, err = reopened.Get(failed.ID); err != nil || entry.Status != StatusFailed || entry.Error != "broken input" {
+		t.Fatalf("unexpected failed entry %+v: %v", entry, err)
+	}
+	if _, err = reopened.Get("../../etc/passwd"); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("expected ErrInvalidID, got %v", err)
+	}
+}
+
+func TestJournalPrune(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _ := j.Append(Entry{Kind: "image"}, []byte("done"))
+	pending, _ := j.Append(Entry{Kind: "image"}, []byte("pending"))
+	if err = j.Done(done.ID, "path", nil); err != nil {
+		t.Fatal(err)
+	}
+	// left over by a crash between the input and the entry writes
+	orphan := filepath.Join(dir, "0123456789abcdef0123456789abcdef"+dataExtension)
+	if err = ioutil.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = j.Prune(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Get(done.ID); err != nil {
+		t.Fatal("recent done job should be kept")
+	}
+	if _, err = os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("orphan input should be removed")
+	}
+
+	if err = j.Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Get(done.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("done job should be pruned, got %v", err)
+	}
+	if _, err = j.Get(pending.ID); err != nil {
+		t.Fatal("pending job should never be pruned")
+	}
+}
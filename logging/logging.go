@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Extra fields of a log line
+type Fields map[string]interface{}
+
+/*
+Writes one json object per line with the time, level, message, error and fields.
+Loggers made by With share the output of their parent.
+*/
+type Logger struct {
+	out    *output
+	fields Fields
+}
+
+type output struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func New(w io.Writer) *Logger {
+	return &Logger{out: &output{w: w}}
+}
+
+// Used by the package functions and as the parent of the request loggers
+var Default = New(os.Stderr)
+
+// Redirect the output of the logger and of every logger made from it
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.w = w
+}
+
+// Logger adding fields to every line, on top of the fields of l
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, fields: merged}
+}
+
+/*
+Messages of err and of every error it wraps, outermost first,
+so the root cause is the last one
+*/
+func ErrorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		chain = append(chain, err.Error())
+	}
+	return chain
+}
+
+func (l *Logger) log(level, msg string, err error, fields Fields) {
+	line := make(Fields, len(l.fields)+len(fields)+5)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = msg
+	if err != nil {
+		line["error"] = err.Error()
+		if chain := ErrorChain(err); len(chain) > 1 {
+			line["error_chain"] = chain
+		}
+	}
+
+	data, marshalErr := json.Marshal(line)
+	if marshalErr != nil {
+		// a field can't be encoded, don't lose the line
+		data, _ = json.Marshal(Fields{
+			"time":  line["time"],
+			"level": level,
+			"msg":   msg,
+			"error": fmt.Sprintf("%v (fields dropped: %v)", err, marshalErr),
+		})
+	}
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.w.Write(append(data, '\n'))
+}
+
+func (l *Logger) Info(msg string, fields Fields) {
+	l.log(LevelInfo, msg, nil, fields)
+}
+
+func (l *Logger) Warn(msg string, err error, fields Fields) {
+	l.log(LevelWarn, msg, err, fields)
+}
+
+func (l *Logger) Error(msg string, err error, fields Fields) {
+	l.log(LevelError, msg, err, fields)
+}
+
+func Info(msg string, fields Fields) {
+	Default.Info(msg, fields)
+}
+
+func Warn(msg string, err error, fields Fields) {
+	Default.Warn(msg, err, fields)
+}
+
+func Error(msg string, err error, fields Fields) {
+	Default.Error(msg, err, fields)
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLoggerLine(t *testing.T) {
+	var buf bytes.Buffer
+	root := errors.New("disk full")
+	logger := New(&buf).With(Fields{"request_id": "abc", "router": "image"})
+	logger.Error("save failed", fmt.Errorf("storage: %w", root), Fields{"file_size": 42})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != LevelError || line["msg"] != "save failed" || line["error"] != "storage: disk full" {
+		t.Fatalf("unexpected line %v", line)
+	}
+	if line["request_id"] != "abc" || line["router"] != "image" || line["file_size"] != float64(42) {
+		t.Fatalf("missing fields in %v", line)
+	}
+	chain, _ := line["error_chain"].([]interface{})
+	if len(chain) != 2 || chain[1] != "disk full" {
+		t.Fatalf("unexpected error chain %v", line["error_chain"])
+	}
+}
+
+func TestLoggerWith(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf).With(Fields{"router": "image"})
+	parent.With(Fields{"router": "audio", "job_id": "1"})
+	parent.Info("started", nil)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["router"] != "image" || line["job_id"] != nil {
+		t.Fatalf("parent fields changed: %v", line)
+	}
+	if _, ok := line["error"]; ok {
+		t.Fatalf("unexpected error field in %v", line)
+	}
+}
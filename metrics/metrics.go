@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "mediaproxy"
+
+// Label values of the outcome of an operation
+const (
+	StatusOk    = "ok"
+	StatusError = "error"
+)
+
+// Every mediaproxy metric is registered here, along with the go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// 16KiB to 256MiB, from a small avatar to the largest buffer of util.BufferPool
+var sizeBuckets = prometheus.ExponentialBuckets(16*1024, 4, 8)
+
+// 5ms to ~40s, a quick svg minification to an ffmpeg run hitting its timeout
+var durationBuckets = prometheus.ExponentialBuckets(0.005, 2.5, 11)
+
+var (
+	UploadsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Uploads handled, by router, preset and http status.",
+	}, []string{"router", "preset", "status"})
+
+	UploadSize = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of the uploaded files, by router, preset and http status.",
+		Buckets:   sizeBuckets,
+	}, []string{"router", "preset", "status"})
+
+	QueueDepth = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Jobs waiting in the queue, by processor.",
+	}, []string{"processor"})
+
+	QueueWait = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time jobs spent in the queue before a worker picked them, by processor.",
+		Buckets:   durationBuckets,
+	}, []string{"processor"})
+
+	TransformDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_transform_duration_seconds",
+		Help:      "Time spent transforming images, retries included, by output type and status.",
+		Buckets:   durationBuckets,
+	}, []string{"type", "status"})
+
+	FFmpegDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_duration_seconds",
+		Help:      "Time spent by ffmpeg converting audio files, by status.",
+		Buckets:   durationBuckets,
+	}, []string{"status"})
+
+	StorageSaveDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_save_duration_seconds",
+		Help:      "Latency of the storage Save calls, by backend and status.",
+		Buckets:   durationBuckets,
+	}, []string{"backend", "status"})
+
+	StorageErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed storage calls, by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	CompressionSaved = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compression_saved_bytes_total",
+		Help:      "Bytes saved by processing the uploads, input size minus stored size, by router.",
+	}, []string{"router"})
+)
+
+func status(err error) string {
+	if err != nil {
+		return StatusError
+	}
+	return StatusOk
+}
+
+// Time elapsed since start, in seconds
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+func ObserveTransform(imageType string, start time.Time, err error) {
+	TransformDuration.WithLabelValues(imageType, status(err)).Observe(since(start))
+}
+
+func ObserveFFmpeg(start time.Time, err error) {
+	FFmpegDuration.WithLabelValues(status(err)).Observe(since(start))
+}
+
+// Count the bytes saved by processing an upload, a larger output saves nothing
+func ObserveCompression(router string, inputSize, outputSize int) {
+	if saved := inputSize - outputSize; saved > 0 {
+		CompressionSaved.WithLabelValues(router).Add(float64(saved))
+	}
+}
+
+// Serve the registry in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
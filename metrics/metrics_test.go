@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploads(t *testing.T) {
+	handler := Uploads("test")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		SetUpload(r.Context(), "avatar", 2048)
+		w.Write([]byte("ok"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("file")))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/rejected", strings.NewReader("file")))
+
+	if n := testutil.ToFloat64(UploadsTotal.WithLabelValues("test", "avatar", "200")); n != 1 {
+		t.Fatalf("expected 1 ok upload, got %v", n)
+	}
+	if n := testutil.ToFloat64(UploadsTotal.WithLabelValues("test", "", "403")); n != 1 {
+		t.Fatalf("expected 1 rejected upload, got %v", n)
+	}
+}
+
+type failingStorage struct{}
+
+var errBackendDown = errors.New("backend down")
+
+func (failingStorage) Save(fileName, contentType string, buf *[]byte) (string, error) {
+	return "", errBackendDown
+}
+
+func (failingStorage) Load(fileName string) (*[]byte, error) {
+	if fileName == "missing" {
+		return nil, storage.ErrNotFound
+	}
+	return nil, errBackendDown
+}
+
+func (failingStorage) Delete(fileName string) error {
+	return errBackendDown
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	s := InstrumentStorage(failingStorage{})
+	if InstrumentStorage(s) != s {
+		t.Fatal("storage instrumented twice")
+	}
+	backend := BackendName(failingStorage{})
+
+	buf := []byte("data")
+	if _, err := s.Save("file", "text/plain", &buf); err != errBackendDown {
+		t.Fatalf("expected the backend error, got %v", err)
+	}
+	s.Load("missing")
+	s.Load("file")
+
+	if n := testutil.ToFloat64(StorageErrors.WithLabelValues(backend, OperationSave)); n != 1 {
+		t.Fatalf("expected 1 save error, got %v", n)
+	}
+	// a missing file is not an error of the backend
+	if n := testutil.ToFloat64(StorageErrors.WithLabelValues(backend, OperationLoad)); n != 1 {
+		t.Fatalf("expected 1 load error, got %v", n)
+	}
+}
+
+func TestObserveCompression(t *testing.T) {
+	ObserveCompression("compression", 1000, 400)
+	// a larger output saves nothing
+	ObserveCompression("compression", 400, 1000)
+	if n := testutil.ToFloat64(CompressionSaved.WithLabelValues("compression")); n != 600 {
+		t.Fatalf("expected 600 bytes saved, got %v", n)
+	}
+}
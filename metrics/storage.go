@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/storage"
+	"time"
+)
+
+// Storage calls labelled in StorageErrors
+const (
+	OperationSave   = "save"
+	OperationLoad   = "load"
+	OperationDelete = "delete"
+)
+
+// Storage reporting the latency and the errors of the wrapped backend
+type Storage struct {
+	storage.Storage
+	Backend string
+}
+
+// Name of the backend used as the backend label
+func BackendName(s storage.Storage) string {
+	switch s.(type) {
+	case storage.S3Storage:
+		return "s3"
+	case storage.FileSystemStorage:
+		return "fs"
+	default:
+		return fmt.Sprintf("%T", s)
+	}
+}
+
+// Wrap s, nil and already instrumented storages are returned as is
+func InstrumentStorage(s storage.Storage) storage.Storage {
+	switch s.(type) {
+	case nil, Storage:
+		return s
+	}
+	return Storage{Storage: s, Backend: BackendName(s)}
+}
+
+func (s Storage) Save(fileName, contentType string, buf *[]byte) (string, error) {
+	start := time.Now()
+	path, err := s.Storage.Save(fileName, contentType, buf)
+	StorageSaveDuration.WithLabelValues(s.Backend, status(err)).Observe(since(start))
+	if err != nil {
+		StorageErrors.WithLabelValues(s.Backend, OperationSave).Inc()
+	}
+	return path, err
+}
+
+// A missing file is not a backend error
+func (s Storage) Load(fileName string) (*[]byte, error) {
+	buf, err := s.Storage.Load(fileName)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		StorageErrors.WithLabelValues(s.Backend, OperationLoad).Inc()
+	}
+	return buf, err
+}
+
+func (s Storage) Delete(fileName string) error {
+	err := s.Storage.Delete(fileName)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		StorageErrors.WithLabelValues(s.Backend, OperationDelete).Inc()
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"github.com/aperture147/mediaproxy/httputil"
+	"net/http"
+	"strconv"
+)
+
+const uploadKey = "metricsUpload"
+
+// Filled by the upload handler, the middleware only knows the request
+type upload struct {
+	preset string
+	size   int64
+}
+
+/*
+Middleware counting the uploads of a router, put it first so the uploads
+rejected by the other middlewares are counted too. Those are labelled with
+an empty preset and the request size, see SetUpload.
+*/
+func Uploads(router string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := &upload{size: r.ContentLength}
+			sw := httputil.NewStatusWriter(w)
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), uploadKey, info)))
+
+			status := strconv.Itoa(sw.Status())
+			UploadsTotal.WithLabelValues(router, info.preset, status).Inc()
+			if info.size >= 0 {
+				UploadSize.WithLabelValues(router, info.preset, status).Observe(float64(info.size))
+			}
+		})
+	}
+}
+
+// Label the upload of the request with its preset and the size of the uploaded file
+func SetUpload(ctx context.Context, preset string, size int) {
+	if info, ok := ctx.Value(uploadKey).(*upload); ok {
+		info.preset = preset
+		info.size = int64(size)
+	}
+}
@@ -3,7 +3,7 @@ package processor
 import (
 	"context"
 	"github.com/aperture147/mediaproxy/util"
-	"log"
+	"time"
 )
 
 const (
@@ -13,23 +13,24 @@ const (
 	// We can easily calculated the buffer size of a 5 mins 128k bit rate mp3 file
 	// would have size of approx 4.8MB or 4.58 MiB. Rounded to 5MiB
 	DefaultAudioBufferSize = 5
+	// is 10 too much?
+	DefaultAudioQueueSize = 10
 )
 
 type AudioResult struct {
-	// Object that contains the audio conversion error
-	ConvertError error
+	// Error wraps the audio conversion error
+	Result
 
-	// Buffer pointer that point to the audio
-	Buffer *[]byte
-
-	// This is used to signal other goroutine
-	// which is waiting for the processed result
-	context.Context
-	// CancelFunc Shouldn't be called outside of the processor
-	Cancel context.CancelFunc
+	// Read from the mp3 frames of the output, 0 when they can't be read
+	Duration time.Duration
+	Bitrate  int // bits per second
 }
 
 type Audio struct {
+	// Context of the caller, the audio is skipped once it's done
+	// and ffmpeg is killed if it's done while converting
+	context.Context
+
 	Data   *[]byte
 	Result *AudioResult
 
@@ -38,82 +39,80 @@ type Audio struct {
 	// TODO: Allow user to pass some Audio processing options
 }
 
+func (audio *Audio) Process(ctx context.Context) error {
+	result, err := util.AudioDownSampleToMp3(ctx, audio.Data, DefaultAudioBufferSize)
+	if err != nil {
+		return err
+	}
+	audio.Result.Buffer = result
+	if info, ok := util.ReadMp3Info(*result); ok {
+		audio.Result.Duration, audio.Result.Bitrate = info.Duration, info.Bitrate
+	}
+	return nil
+}
+
+func (audio *Audio) Complete(err error) {
+	audio.Result.complete("audio", err)
+}
+
 type AudioProcessorOptions struct {
 	// Number of routines/threads should be run
 	Routines int
-}
 
-type AudioProcessor struct {
-	Queue chan *Audio
+	// Max number of audio files waiting to be processed
+	QueueSize int
 
-	// Make use of context pattern
-	// This is used for inter-process cancelling method
-	context.Context
-	Cancel context.CancelFunc
+	// How long AddAudio waits for room in a full queue before giving up
+	// with ErrQueueFull, 0 gives up right away
+	EnqueueTimeout time.Duration
+
+	// Max time ffmpeg may spend on a single file, 0 only keeps the
+	// util.DefaultDownSampleTimeout
+	JobTimeout time.Duration
+
+	// Low priority audio files waiting for longer than this go first,
+	// 0 uses DefaultAgingThreshold, a negative value disables aging
+	AgingThreshold time.Duration
 
-	AudioProcessorOptions
+	// Bounds of the worker count, Routines is the initial count
+	Autoscale AutoscaleOptions
 }
 
-func (p *AudioProcessor) Start() {
-	log.Printf("Starting %d routines\n", p.Routines)
-	for i := 1; i <= p.Routines; i++ {
-		go p.Run()
-	}
+type AudioProcessor struct {
+	Pool
 }
 
 func NewAudioProcessor(parentCtx context.Context, options AudioProcessorOptions) AudioProcessor {
-	ctx, cancel := func() (context.Context, context.CancelFunc) {
-		ctx := context.Background()
-		if parentCtx != nil {
-			ctx = parentCtx
-		}
-		return context.WithCancel(ctx)
-	}()
 	p := AudioProcessor{
-		Context: ctx,
-		Cancel:  cancel,
-		Queue:   make(chan *Audio, 10), // is 10 too much?
-		AudioProcessorOptions: AudioProcessorOptions{
-			Routines: func() int {
-				if options.Routines != 0 {
-					return options.Routines
+		Pool: NewPool(parentCtx, PoolOptions{
+			Name:     KindAudio,
+			Routines: options.Routines,
+			QueueSize: func() int {
+				if options.QueueSize != 0 {
+					return options.QueueSize
 				}
-				return DefaultRoutines
+				return DefaultAudioQueueSize
 			}(),
-		},
+			EnqueueTimeout: options.EnqueueTimeout,
+			JobTimeout:     options.JobTimeout,
+			AgingThreshold: options.AgingThreshold,
+			Autoscale:      options.Autoscale,
+		}),
 	}
 	p.Start()
 	return p
 }
 
-func (p *AudioProcessor) AddAudio(data *[]byte) (*AudioResult, error) {
-	ctx, err := context.WithCancel(context.Background())
-	result := &AudioResult{
-		Buffer:  data,
-		Context: ctx,
-		Cancel:  err,
+func (p *AudioProcessor) AddAudio(jobCtx context.Context, data *[]byte) (*AudioResult, error) {
+	result := &AudioResult{Result: newResult(data)}
+	job := &Audio{
+		Context: jobContext(jobCtx),
+		Data:    data,
+		Result:  result,
 	}
-	p.Queue <- &Audio{
-		Data:   data,
-		Result: result,
+	if err := p.Add(job); err != nil {
+		result.Cancel()
+		return nil, err
 	}
 	return result, nil
 }
-
-func (p *AudioProcessor) Run() {
-	for {
-		select {
-		case <-p.Done():
-			log.Println("Audio Processor stopped")
-			return
-		case audio := <-p.Queue:
-			result, err := util.AudioDownSampleToMp3(audio.Data, DefaultAudioBufferSize)
-			if err != nil {
-				audio.Result.ConvertError = err
-				continue
-			}
-			audio.Result.Buffer = result
-			audio.Result.Cancel()
-		}
-	}
-}
@@ -2,10 +2,15 @@ package processor
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"github.com/aperture147/mediaproxy/util"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFFmpegPipe(t *testing.T) {
@@ -69,3 +74,128 @@ func TestFFmpegPipe(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAudioProcessorSkipsCancelledJob(t *testing.T) {
+	p := NewAudioProcessor(nil, AudioProcessorOptions{Routines: 1})
+	defer p.Cancel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := []byte("not even audio")
+	result, err := p.AddAudio(ctx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-result.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled audio never completed")
+	}
+	if !errors.Is(result.Error, context.Canceled) {
+		t.Fatalf("expected the job to be skipped, got %v", result.Error)
+	}
+}
+
+// Use a fake ffmpeg running the shell command, the returned function restores the real one
+func fakeFFmpeg(t *testing.T, command string) func() {
+	script := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+command+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	util.SetFFmpegPath(script)
+	return func() { util.SetFFmpegPath(util.DefaultFFmpegPath) }
+}
+
+// Fake ffmpeg hanging forever, exec makes sure no orphan keeps the pipes open once it's killed
+func hangingFFmpeg(t *testing.T) func() {
+	return fakeFFmpeg(t, "exec sleep 60")
+}
+
+func TestAudioProcessorOutput(t *testing.T) {
+	defer fakeFFmpeg(t, "exec cat")()
+
+	p := NewAudioProcessor(nil, AudioProcessorOptions{Routines: 1})
+	defer p.Cancel()
+
+	data := []byte("converted audio")
+	result, err := p.AddAudio(context.Background(), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-result.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("overslept")
+	}
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	// the output used to be prefixed by the zeroed initial buffer
+	if !bytes.Equal(*result.Buffer, data) {
+		t.Fatalf("expected %q, got %d bytes", data, len(*result.Buffer))
+	}
+}
+
+func TestAudioProcessorKillsFFmpeg(t *testing.T) {
+	defer hangingFFmpeg(t)()
+
+	p := NewAudioProcessor(nil, AudioProcessorOptions{Routines: 1})
+	defer p.Cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	data := []byte("not even audio")
+	result, err := p.AddAudio(ctx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-result.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ffmpeg was not killed when the caller went away")
+	}
+	if !errors.Is(result.Error, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", result.Error)
+	}
+}
+
+func TestAudioProcessorShutdownTimeout(t *testing.T) {
+	defer hangingFFmpeg(t)()
+
+	p := NewAudioProcessor(nil, AudioProcessorOptions{Routines: 1})
+	defer p.Cancel()
+
+	// kills the audio stuck in ffmpeg once the test is done
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	data := []byte("not even audio")
+	running, err := p.AddAudio(jobCtx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// let the worker pick the first audio
+	for p.QueueDepth() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued, err := p.AddAudio(jobCtx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	select {
+	case <-queued.Done():
+	default:
+		t.Fatal("queued audio was not failed")
+	}
+	if !errors.Is(queued.Error, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", queued.Error)
+	}
+	if running.Err() != nil {
+		t.Fatal("running audio should be left to finish")
+	}
+}
@@ -0,0 +1,338 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// Jobs waiting or running for longer than this ask for more workers
+	DefaultTargetLatency = 2 * time.Second
+	// How often the worker count is reconsidered
+	DefaultScaleInterval = time.Second
+	// How long workers must have been idle before one of them is stopped
+	DefaultScaleDownDelay = 30 * time.Second
+	// Workers allowed per cpu, the jobs are cpu bound
+	DefaultWorkersPerCPU = 1
+)
+
+// Weight of the last job in the latency moving average
+const latencyWeight = 0.2
+
+var ErrInvalidWorkerBounds = errors.New("invalid worker bounds")
+
+/*
+Bounds of the worker count. The pool starts with Routines workers then adds
+workers while jobs wait for longer than TargetLatency, and stops them once
+they sit idle. Autoscaling is disabled unless MaxRoutines > MinRoutines.
+MaxRoutines is capped by the cpus and by the memory budget, a MinRoutines
+above the cap still wins.
+*/
+type AutoscaleOptions struct {
+	// Min number of workers, 0 uses Routines
+	MinRoutines int
+
+	// Max number of workers, 0 uses Routines
+	MaxRoutines int
+
+	// Observed latency (queue wait and processing) the pool tries to stay under,
+	// 0 uses DefaultTargetLatency
+	TargetLatency time.Duration
+
+	// 0 uses DefaultScaleInterval
+	Interval time.Duration
+
+	// 0 uses DefaultScaleDownDelay
+	ScaleDownDelay time.Duration
+
+	// Max workers per cpu, 0 uses DefaultWorkersPerCPU
+	WorkersPerCPU int
+
+	// Memory a single worker may need and memory all the workers may take,
+	// in bytes. The memory cap is disabled unless both are set
+	WorkerMemory int64
+	MemoryBudget int64
+}
+
+func (o AutoscaleOptions) withDefaults(routines int) AutoscaleOptions {
+	if o.MinRoutines <= 0 {
+		o.MinRoutines = routines
+	}
+	if o.MaxRoutines <= 0 {
+		o.MaxRoutines = routines
+	}
+	if o.TargetLatency <= 0 {
+		o.TargetLatency = DefaultTargetLatency
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultScaleInterval
+	}
+	if o.ScaleDownDelay <= 0 {
+		o.ScaleDownDelay = DefaultScaleDownDelay
+	}
+	if o.WorkersPerCPU <= 0 {
+		o.WorkersPerCPU = DefaultWorkersPerCPU
+	}
+	return o
+}
+
+// Max number of workers the machine can take
+func (o AutoscaleOptions) Limit() int {
+	limit := runtime.NumCPU() * o.WorkersPerCPU
+	if o.WorkerMemory > 0 && o.MemoryBudget > 0 {
+		if memory := int(o.MemoryBudget / o.WorkerMemory); memory < limit {
+			limit = memory
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// Clamp the bounds, min stays at least 1, an autoscaled max between min and the limit
+func (o AutoscaleOptions) bounds(min, max int) (int, int) {
+	if min < 1 {
+		min = 1
+	}
+	if limit := o.Limit(); max > min && max > limit {
+		max = limit
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// Worker count of a pool, reported by the admin endpoint
+type WorkerStatus struct {
+	Name       string `json:"name"`
+	Workers    int    `json:"workers"`
+	Busy       int    `json:"busy"`
+	MinWorkers int    `json:"min_workers"`
+	MaxWorkers int    `json:"max_workers"`
+	// Max workers allowed by the cpus and the memory budget
+	Limit      int `json:"limit"`
+	QueueDepth int `json:"queue_depth"`
+	// Moving average of the queue wait plus the processing time
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// Implemented by every processor, lets the worker count be changed at runtime
+type Scaler interface {
+	WorkerStatus() WorkerStatus
+	SetWorkerBounds(min, max int) (WorkerStatus, error)
+}
+
+/*
+Worker count of a pool, shared by every copy of the pool.
+Each worker has its own quit channel, closing it stops the worker once its job is done.
+Once started, workers are only added by the autoscale goroutine, which is tracked
+along with the workers so none is added after they all returned.
+*/
+type scaler struct {
+	mutex sync.Mutex
+	AutoscaleOptions
+
+	quits     []chan struct{}
+	busy      int
+	latency   time.Duration
+	idleSince time.Time
+
+	// Start time of the running jobs, the heartbeats of the busy workers
+	running map[uint64]time.Time
+	lastJob uint64
+
+	// Wakes the autoscale goroutine up when the bounds change
+	wake chan struct{}
+	// Closed along with the queue
+	stopped chan struct{}
+}
+
+func newScaler(options AutoscaleOptions, routines int) *scaler {
+	options = options.withDefaults(routines)
+	options.MinRoutines, options.MaxRoutines = options.bounds(options.MinRoutines, options.MaxRoutines)
+	return &scaler{
+		AutoscaleOptions: options,
+		running:          make(map[uint64]time.Time),
+		wake:             make(chan struct{}, 1),
+		stopped:          make(chan struct{}),
+	}
+}
+
+// Bring n within the bounds
+func (s *scaler) clamp(n int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n < s.MinRoutines {
+		return s.MinRoutines
+	}
+	if n > s.MaxRoutines {
+		return s.MaxRoutines
+	}
+	return n
+}
+
+// Add or stop workers until there are n of them
+func (p *Pool) resize(n int) {
+	if p.isClosed() || p.Err() != nil {
+		return
+	}
+
+	s := p.scaler
+	s.mutex.Lock()
+	before := len(s.quits)
+	for len(s.quits) < n {
+		quit := make(chan struct{})
+		s.quits = append(s.quits, quit)
+		p.state.run(func() { p.work(quit) })
+	}
+	for len(s.quits) > n {
+		last := len(s.quits) - 1
+		close(s.quits[last])
+		s.quits = s.quits[:last]
+	}
+	s.idleSince = time.Time{}
+	s.mutex.Unlock()
+
+	if n != before && p.OnScale != nil {
+		p.OnScale(n)
+	}
+}
+
+// Worker count the pool should have, n when it's fine
+func (s *scaler) desired(depth int, oldestWait time.Duration, now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := len(s.quits)
+	latency := s.latency
+	if oldestWait > latency {
+		latency = oldestWait
+	}
+
+	switch {
+	case n < s.MinRoutines:
+		return s.MinRoutines
+	case n > s.MaxRoutines:
+		return s.MaxRoutines
+	case depth > 0 && latency > s.TargetLatency && n < s.MaxRoutines:
+		// one more worker per batch of jobs waiting behind each worker
+		n += (depth + n - 1) / n
+		if n > s.MaxRoutines {
+			n = s.MaxRoutines
+		}
+		return n
+	case depth == 0 && s.busy < n && n > s.MinRoutines:
+		if s.idleSince.IsZero() {
+			s.idleSince = now
+		} else if now.Sub(s.idleSince) >= s.ScaleDownDelay {
+			return n - 1
+		}
+	default:
+		s.idleSince = time.Time{}
+	}
+	return n
+}
+
+// Reconsider the worker count every Interval and when the bounds change, until the pool stops
+func (p *Pool) autoscale() {
+	ticker := time.NewTicker(p.scaler.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.Done():
+			return
+		case <-p.scaler.stopped:
+			return
+		case <-ticker.C:
+		case <-p.scaler.wake:
+		}
+		if n, current := p.scaler.desired(p.Queue.Len(), p.Queue.OldestWait(), time.Now()), p.workers(); n != current {
+			logging.Info("processor scaled", logging.Fields{"processor": p.Name, "from": current, "to": n})
+			p.resize(n)
+		}
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.state.RLock()
+	defer p.state.RUnlock()
+	return p.state.closed
+}
+
+func (p *Pool) workers() int {
+	p.scaler.mutex.Lock()
+	defer p.scaler.mutex.Unlock()
+	return len(p.scaler.quits)
+}
+
+// Track the busy workers and the latency of the jobs, the returned id is passed to jobDone
+func (p *Pool) jobStarted() uint64 {
+	s := p.scaler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy++
+	s.lastJob++
+	s.running[s.lastJob] = time.Now()
+	return s.lastJob
+}
+
+func (p *Pool) jobDone(id uint64, latency time.Duration) {
+	s := p.scaler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy--
+	delete(s.running, id)
+	if s.latency == 0 {
+		s.latency = latency
+		return
+	}
+	s.latency += time.Duration(latencyWeight * float64(latency-s.latency))
+}
+
+func (p *Pool) WorkerStatus() WorkerStatus {
+	s := p.scaler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return WorkerStatus{
+		Name:       p.Name,
+		Workers:    len(s.quits),
+		Busy:       s.busy,
+		MinWorkers: s.MinRoutines,
+		MaxWorkers: s.MaxRoutines,
+		Limit:      s.Limit(),
+		QueueDepth: p.Queue.Len(),
+		LatencyMs:  s.latency.Milliseconds(),
+	}
+}
+
+/*
+Change the worker bounds at runtime, an autoscaled max is capped by the cpus and
+the memory budget. The workers are brought within the new bounds right after.
+*/
+func (p *Pool) SetWorkerBounds(min, max int) (WorkerStatus, error) {
+	if min < 1 || max < min {
+		return p.WorkerStatus(), fmt.Errorf("%w: min %d, max %d", ErrInvalidWorkerBounds, min, max)
+	}
+	if p.isClosed() || p.Err() != nil {
+		return p.WorkerStatus(), ErrShuttingDown
+	}
+
+	s := p.scaler
+	s.mutex.Lock()
+	min, max = s.bounds(min, max)
+	s.MinRoutines, s.MaxRoutines = min, max
+	s.mutex.Unlock()
+	logging.Info("processor bounds set", logging.Fields{"processor": p.Name, "min": min, "max": max})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already woken up
+	}
+	return p.WorkerStatus(), nil
+}
@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitWorkers(t *testing.T, p *Pool, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.WorkerStatus().Workers != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d workers, got %+v", n, p.WorkerStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolAutoscale(t *testing.T) {
+	var scaled int32
+	p := NewPool(nil, PoolOptions{
+		Name:      "test",
+		Routines:  1,
+		QueueSize: 16,
+		Autoscale: AutoscaleOptions{
+			MinRoutines:    1,
+			MaxRoutines:    4,
+			TargetLatency:  10 * time.Millisecond,
+			Interval:       5 * time.Millisecond,
+			ScaleDownDelay: 50 * time.Millisecond,
+			// don't let a small test machine cap the workers
+			WorkersPerCPU: 4,
+		},
+		OnScale: func(workers int) { atomic.StoreInt32(&scaled, int32(workers)) },
+	})
+	p.Start()
+	defer p.Cancel()
+	waitWorkers(t, &p, 1)
+
+	release := make(chan struct{})
+	jobs := make([]*funcJob, 8)
+	for i := range jobs {
+		jobs[i] = newFuncJob(func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+		if err := p.Add(jobs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the jobs pile up behind the single worker
+	waitWorkers(t, &p, 4)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.WorkerStatus().Busy != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 busy workers, got %+v", p.WorkerStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&scaled); n != 4 {
+		t.Fatalf("expected OnScale to get 4 workers, got %d", n)
+	}
+
+	close(release)
+	for _, job := range jobs {
+		if err := waitJob(t, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// idle workers are stopped one by one
+	waitWorkers(t, &p, 1)
+}
+
+func TestPoolSetWorkerBounds(t *testing.T) {
+	p := NewPool(nil, PoolOptions{Name: "test", Routines: 2})
+	p.Start()
+	defer p.Cancel()
+	waitWorkers(t, &p, 2)
+
+	if _, err := p.SetWorkerBounds(0, 2); !errors.Is(err, ErrInvalidWorkerBounds) {
+		t.Fatalf("expected ErrInvalidWorkerBounds, got %v", err)
+	}
+	if _, err := p.SetWorkerBounds(3, 2); !errors.Is(err, ErrInvalidWorkerBounds) {
+		t.Fatalf("expected ErrInvalidWorkerBounds, got %v", err)
+	}
+
+	status, err := p.SetWorkerBounds(3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.MinWorkers != 3 || status.MaxWorkers != 3 {
+		t.Fatalf("unexpected bounds %+v", status)
+	}
+	waitWorkers(t, &p, 3)
+
+	if _, err = p.SetWorkerBounds(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitWorkers(t, &p, 1)
+
+	// the remaining worker still processes jobs
+	job := newFuncJob(func(ctx context.Context) error { return nil })
+	if err = p.Add(job); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitJob(t, job); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.SetWorkerBounds(1, 2); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestAutoscaleLimit(t *testing.T) {
+	options := AutoscaleOptions{
+		WorkersPerCPU: 100,
+		WorkerMemory:  100,
+		MemoryBudget:  250,
+	}
+	if limit := options.Limit(); limit != 2 {
+		t.Fatalf("expected the memory budget to allow 2 workers, got %d", limit)
+	}
+	if min, max := options.bounds(1, 10); min != 1 || max != 2 {
+		t.Fatalf("expected [1, 2], got [%d, %d]", min, max)
+	}
+	// a fixed worker count is never capped
+	if min, max := options.bounds(5, 5); min != 5 || max != 5 {
+		t.Fatalf("expected [5, 5], got [%d, %d]", min, max)
+	}
+	// neither is the min
+	if min, max := options.bounds(3, 10); min != 3 || max != 3 {
+		t.Fatalf("expected [3, 3], got [%d, %d]", min, max)
+	}
+}
@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Longest a job may run when the pool has no JobTimeout before its worker is wedged
+const DefaultWedgedAfter = 5 * time.Minute
+
+var ErrWorkerWedged = errors.New("worker wedged")
+
+// Implemented by every processor, used by the liveness probe
+type HealthChecker interface {
+	// Error when a worker is stuck on a job
+	CheckHealth() error
+}
+
+func (p *Pool) wedgedAfter() time.Duration {
+	switch {
+	case p.WedgedAfter > 0:
+		return p.WedgedAfter
+	case p.JobTimeout > 0:
+		return 2 * p.JobTimeout
+	}
+	return DefaultWedgedAfter
+}
+
+/*
+Look at the heartbeat of the busy workers: a job is given its context deadline,
+a worker still running it long after never comes back, e.g. a transform stuck
+in cgo. Only a restart gets the worker back.
+*/
+func (p *Pool) CheckHealth() error {
+	limit := p.wedgedAfter()
+	now := time.Now()
+
+	s := p.scaler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	wedged := 0
+	var oldest time.Duration
+	for _, started := range s.running {
+		if age := now.Sub(started); age > limit {
+			wedged++
+			if age > oldest {
+				oldest = age
+			}
+		}
+	}
+	if wedged > 0 {
+		return fmt.Errorf("%w: %d %s workers on the same job for up to %v", ErrWorkerWedged, wedged, p.Name, oldest.Round(time.Second))
+	}
+	return nil
+}
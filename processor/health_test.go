@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolCheckHealth(t *testing.T) {
+	p := NewPool(nil, PoolOptions{Name: "test", Routines: 1, WedgedAfter: 20 * time.Millisecond})
+	p.Start()
+	defer p.Cancel()
+
+	release := make(chan struct{})
+	job := newFuncJob(func(ctx context.Context) error {
+		// ignores its context, like a job stuck in cgo
+		<-release
+		return nil
+	})
+	if err := p.Add(job); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.WorkerStatus().Busy != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the job never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.CheckHealth(); err != nil {
+		t.Fatalf("a job just started is not wedged: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := p.CheckHealth(); !errors.Is(err, ErrWorkerWedged) {
+		t.Fatalf("expected a wedged worker, got %v", err)
+	}
+
+	close(release)
+	<-job.result.Done()
+	deadline = time.Now().Add(5 * time.Second)
+	for p.CheckHealth() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker still wedged: %v", p.CheckHealth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,15 +1,22 @@
 package processor
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/tracing"
+	"github.com/aperture147/mediaproxy/util"
 	"github.com/discord/lilliput"
-	"log"
-)
+	"go.opentelemetry.io/otel/attribute"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"time"
 
-// Default 3 routines to handle the job
-const DefaultRoutines = 3
+	_ "golang.org/x/image/webp"
+)
 
 const (
 	// Default buffer size in MiB
@@ -20,11 +27,25 @@ const (
 	// given resolution, but it's going to be extremely large.
 	// If you encountered error: "buffer too small to hold image" then just
 	// increase the buffer size or limit the allowed upload image size.
+	// Images added with AddImageBuffer don't use it, they start with a buffer
+	// sized after the image and retry with larger ones.
 	//
 	// Related issue: https://github.com/discord/lilliput/issues/38
 	DefaultImageBufferSize = 50
 	// Default size (4K)
 	DefaultMaxImageSize = 3840
+	// 500 is big enough?
+	DefaultImageQueueSize = 500
+	// Default max number of encodes done while searching for the
+	// quality that matches the target SSIM score
+	DefaultMaxQualityIterations = 6
+)
+
+const (
+	// Quality search range, going below 30 produces visible blocks
+	// whatever the SSIM score says, going above 95 just wastes bytes
+	MinSearchQuality = 30
+	MaxSearchQuality = 95
 )
 
 const (
@@ -39,23 +60,42 @@ var EncodeOptions = map[string]map[int]int{
 	ImageTypeWebp: {lilliput.WebpQuality: 85},
 }
 
+// Encode option keys which control the quality of lossy formats,
+// lossless formats (png) are not listed here and never get a quality search
+var QualityOptions = map[string]int{
+	ImageTypeJpeg: lilliput.JpegQuality,
+	ImageTypeWebp: lilliput.WebpQuality,
+}
+
 var (
 	ErrTransformationError = errors.New("cannot transform the image")
 	ErrNilImageOptions     = errors.New("nil image options")
+	ErrQualitySearchFailed = errors.New("cannot search for target quality")
 )
 
 type ImageResult struct {
-	// Object that contains the image transformation error
-	TransformationError error
+	// Error wraps the image transformation error
+	Result
 
-	// Buffer pointer that point to the image data
-	Buffer *[]byte
+	// Encoder quality chosen by the target quality search,
+	// 0 means the static EncodeOptions were used
+	Quality int
 
-	// This is used to signal other goroutine
-	// which is waiting for the processed result
-	context.Context
-	// CancelFunc Shouldn't be called outside of the processor
-	Cancel context.CancelFunc
+	// Dimensions of the output, read back from the encoded image
+	Width  int
+	Height int
+}
+
+// Read the dimensions from the header of the output, left to 0 when it can't be read
+func (r *ImageResult) readDimensions() {
+	decoder, err := lilliput.NewDecoder(*r.Buffer)
+	if err != nil {
+		return
+	}
+	defer decoder.Close()
+	if header, err := decoder.Header(); err == nil {
+		r.Width, r.Height = header.Width(), header.Height()
+	}
 }
 
 type ImageOptions struct {
@@ -63,9 +103,15 @@ type ImageOptions struct {
 	Width     int
 	Height    int
 	Resize    bool
+
+	// Stamp the processor watermark onto the output, if the processor has one
+	Watermark bool
 }
 
 type Image struct {
+	// Context of the caller, the image is skipped once it's done
+	context.Context
+
 	Data   *lilliput.Decoder
 	Header *lilliput.ImageHeader
 
@@ -74,37 +120,149 @@ type Image struct {
 
 	// Contains the result of the image
 	Result *ImageResult
+
+	// Encoded input, set by AddImageBuffer. The decoder is then owned by the
+	// processor, which decodes the input again to retry with a larger buffer
+	Source []byte
+
+	processor *ImageProcessor
 }
 
-func (p *ImageProcessor) AddImage(data *lilliput.Decoder, opts *ImageOptions) (*ImageResult, error) {
-	header, _ := (*data).Header()
-	ctx, cancel := context.WithCancel(context.Background())
+// Size of the first buffer tried, the raw size of the output is plenty for lossy
+// encoders, a lossless encoding of a noisy image may need a retry
+func (img *Image) bufferSize() int {
+	if img.Source == nil || img.Header == nil {
+		// no retry possible, keep on the safe side
+		return DefaultImageBufferSize * util.MiB
+	}
+	width, height := img.Header.Width(), img.Header.Height()
+	if img.ImageOptions.Resize {
+		width, height = img.ImageOptions.Width, img.ImageOptions.Height
+	}
+	return width * height * 4
+}
+
+// Decoders are single use, start over from the source
+func (img *Image) redecode() error {
+	decoder, err := lilliput.NewDecoder(img.Source)
+	if err != nil {
+		return err
+	}
+	(*img.Data).Close()
+	img.Data = &decoder
+	return nil
+}
 
+func (img *Image) Process(ctx context.Context) error {
+	// Small check to ensure that people will not put null options
+	if img.ImageOptions == nil {
+		return fmt.Errorf("options: %v", ErrNilImageOptions)
+	}
+	ctx, span := tracing.Start(ctx, "image.transform")
+	span.SetAttributes(
+		attribute.String("image.type", img.ImageOptions.ImageType),
+		attribute.Int("image.width", img.ImageOptions.Width),
+		attribute.Int("image.height", img.ImageOptions.Height),
+	)
+	start := time.Now()
+	err := img.transform(ctx)
+	metrics.ObserveTransform(img.ImageOptions.ImageType, start, err)
+	tracing.End(span, err)
+	return err
+}
+
+// Transform with buffers sized after the image, retrying with larger ones when needed
+func (img *Image) transform(ctx context.Context) error {
+	ops := img.processor.Ops.Get()
+	defer img.processor.Ops.Put(ops)
+
+	buffers := img.processor.Buffers
+	size := img.bufferSize()
+	for {
+		buffer := buffers.Get(size)
+		err := img.processor.process(ctx, ops, img, buffer)
+		if err == nil {
+			// the result may point into the pooled buffer
+			result := append([]byte(nil), (*img.Result.Buffer)...)
+			img.Result.Buffer = &result
+			img.Result.readDimensions()
+		}
+		buffers.Put(buffer)
+
+		if errors.Is(err, lilliput.ErrBufTooSmall) && img.Source != nil {
+			if next, ok := buffers.Grow(len(buffer)); ok {
+				if err = img.redecode(); err == nil {
+					size = next
+					continue
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %w", ErrTransformationError, err)
+		}
+		return nil
+	}
+}
+
+func (img *Image) Complete(err error) {
+	if img.Source != nil {
+		(*img.Data).Close()
+	}
+	img.Result.complete("transformation", err)
+}
+
+func (p *ImageProcessor) AddImage(jobCtx context.Context, data *lilliput.Decoder, opts *ImageOptions) (*ImageResult, error) {
+	header, _ := (*data).Header()
+	result := &ImageResult{Result: newResult(nil)}
 	image := &Image{
-		Data:   data,
-		Header: header,
-		Result: &ImageResult{
-			Context: ctx,
-			Cancel:  cancel,
-		},
+		Context:      jobContext(jobCtx),
+		Data:         data,
+		Header:       header,
+		Result:       result,
 		ImageOptions: opts,
+		processor:    p,
 	}
-	p.Queue <- image
+	if err := p.Add(image); err != nil {
+		result.Cancel()
+		return nil, err
+	}
+	return result, nil
+}
 
-	return image.Result, nil
+/*
+Same as AddImage, the processor decodes buf itself and closes the decoder once done.
+Keeping the encoded input lets the processor retry with a larger buffer when the
+output doesn't fit, so the first buffer can be sized after the image.
+*/
+func (p *ImageProcessor) AddImageBuffer(jobCtx context.Context, buf []byte, opts *ImageOptions) (*ImageResult, error) {
+	decoder, err := lilliput.NewDecoder(buf)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := decoder.Header()
+	result := &ImageResult{Result: newResult(nil)}
+	image := &Image{
+		Context:      jobContext(jobCtx),
+		Data:         &decoder,
+		Header:       header,
+		Result:       result,
+		ImageOptions: opts,
+		Source:       buf,
+		processor:    p,
+	}
+	if err = p.Add(image); err != nil {
+		decoder.Close()
+		result.Cancel()
+		return nil, err
+	}
+	return result, nil
 }
 
 type ImageProcessor struct {
-	// ImageOps, do the image transform job
-	Ops *lilliput.ImageOps
-
-	// Simple buffered queue for multiple the processor
-	Queue chan *Image
+	// ImageOps doing the transform jobs, one per running job
+	Ops *OpsPool
 
-	// Make use of context pattern
-	// This is used for inter-process cancelling method
-	context.Context
-	Cancel context.CancelFunc
+	Pool
 
 	ImageProcessorOptions
 }
@@ -115,82 +273,246 @@ type ImageProcessorOptions struct {
 
 	// Number of routines/threads should be run
 	Routines int
+
+	// Max number of images waiting to be processed
+	QueueSize int
+
+	// How long AddImage waits for room in a full queue before giving up
+	// with ErrQueueFull, 0 gives up right away
+	EnqueueTimeout time.Duration
+
+	// Max time spent on a single image, only checked between the encodes
+	// of the quality search since a lilliput transform can't be interrupted.
+	// 0 disables the timeout
+	JobTimeout time.Duration
+
+	// Low priority images waiting for longer than this go first,
+	// 0 uses DefaultAgingThreshold, a negative value disables aging
+	AgingThreshold time.Duration
+
+	// Target SSIM score (0, 1], when set the processor binary-searches the
+	// encoder quality of lossy formats to hit this score against the resized
+	// source instead of using the static EncodeOptions. 0 disables the search
+	TargetQuality float64
+
+	// Max number of encodes done by the quality search, 0 or less uses DefaultMaxQualityIterations
+	MaxQualityIterations int
+
+	// Overlay stamped onto images which ask for it, nil disables watermarking
+	Watermark *Watermark
+
+	// Transform buffers, nil uses util.DefaultBufferPool
+	Buffers *util.BufferPool
+
+	// Bounds of the worker count, Routines is the initial count.
+	// WorkerMemory defaults to the size of the ImageOps framebuffers
+	Autoscale AutoscaleOptions
 }
 
 func NewImageProcessor(parentCtx context.Context, options ImageProcessorOptions) ImageProcessor {
-	ctx, cancel := func() (context.Context, context.CancelFunc) {
-		ctx := context.Background()
-		if parentCtx != nil {
-			ctx = parentCtx
-		}
-		return context.WithCancel(ctx)
-	}()
+	queueSize := options.QueueSize
+	if queueSize == 0 {
+		queueSize = DefaultImageQueueSize
+	}
+	maxImageSize := options.MaxImageSize
+	if maxImageSize == 0 {
+		maxImageSize = DefaultMaxImageSize
+	}
+	autoscale := options.Autoscale
+	if autoscale.WorkerMemory == 0 {
+		// two rgba framebuffers of MaxImageSize
+		autoscale.WorkerMemory = 2 * 4 * int64(maxImageSize) * int64(maxImageSize)
+	}
+	pool := NewPool(parentCtx, PoolOptions{
+		Name:           KindImage,
+		Routines:       options.Routines,
+		QueueSize:      queueSize,
+		EnqueueTimeout: options.EnqueueTimeout,
+		JobTimeout:     options.JobTimeout,
+		AgingThreshold: options.AgingThreshold,
+		Autoscale:      autoscale,
+	})
+	ops := NewOpsPool(maxImageSize, pool.Routines)
+	// jobs may still hold some ops, they are freed when given back
+	pool.OnStop = ops.Close
+	// keep one idle ops per worker
+	pool.OnScale = ops.Resize
 	p := ImageProcessor{
-		Ops:     lilliput.NewImageOps(options.MaxImageSize),
-		Context: ctx,
-		Cancel:  cancel,
-		Queue:   make(chan *Image, 500), // 500 is big enough?
+		Ops:  ops,
+		Pool: pool,
 		ImageProcessorOptions: ImageProcessorOptions{
-			MaxImageSize: func() int {
-				if options.MaxImageSize != 0 {
-					return options.MaxImageSize
+			MaxImageSize:   maxImageSize,
+			Routines:       pool.Routines,
+			QueueSize:      queueSize,
+			EnqueueTimeout: options.EnqueueTimeout,
+			JobTimeout:     options.JobTimeout,
+			AgingThreshold: pool.AgingThreshold,
+			TargetQuality:  options.TargetQuality,
+			MaxQualityIterations: func() int {
+				if options.MaxQualityIterations > 0 {
+					return options.MaxQualityIterations
 				}
-				return DefaultMaxImageSize
+				return DefaultMaxQualityIterations
 			}(),
-			Routines: func() int {
-				if options.Routines != 0 {
-					return options.Routines
+			Watermark: options.Watermark,
+			Buffers: func() *util.BufferPool {
+				if options.Buffers != nil {
+					return options.Buffers
 				}
-				return DefaultRoutines
+				return util.DefaultBufferPool
 			}(),
+			Autoscale: autoscale,
 		},
 	}
 	p.Start()
 	return p
 }
 
-func (p *ImageProcessor) Start() {
-	log.Printf("Starting %d routines\n", p.Routines)
-	for i := 1; i <= p.Routines; i++ {
-		go p.Run()
+func resizeMethod(imgOpts *ImageOptions) lilliput.ImageOpsSizeMethod {
+	if imgOpts.Resize {
+		return lilliput.ImageOpsFit
 	}
+	return lilliput.ImageOpsNoResize
 }
 
-func (p *ImageProcessor) Run() {
-	for {
-		select {
-		case <-p.Done():
-			p.Ops.Close()
-			log.Println("Image Processor stopped")
-			return
-		case image := <-p.Queue:
-			buffer := make([]byte, DefaultImageBufferSize*1024*1024)
-			imgOpts := image.ImageOptions
-			// Small check to ensure that people will not put null options
-			if imgOpts != nil {
-				opts := &lilliput.ImageOptions{
-					FileType: "." + imgOpts.ImageType,
-					Width:    imgOpts.Width,
-					Height:   imgOpts.Height,
-					ResizeMethod: func() lilliput.ImageOpsSizeMethod {
-						if imgOpts.Resize {
-							return lilliput.ImageOpsFit
-						}
-						return lilliput.ImageOpsNoResize
-					}(),
-					EncodeOptions: EncodeOptions[imgOpts.ImageType],
-				}
-				resultBuffer, err := p.Ops.Transform(*image.Data, opts, buffer)
-				if err != nil {
-					image.Result.TransformationError = fmt.Errorf("transformation: %v", fmt.Errorf("%v: %v", ErrTransformationError, err))
-				} else {
-					image.Result.Buffer = &resultBuffer
-				}
-				p.Ops.Clear()
-			} else {
-				image.Result.TransformationError = fmt.Errorf("options: %v", ErrNilImageOptions)
+/*
+Most images go straight through a single lilliput transform. When the output needs
+some extra work (watermark, target quality search) the image is first resized into
+a lossless png reference, the extra steps are done on that reference, then it's
+encoded into the requested type.
+*/
+func (p *ImageProcessor) process(ctx context.Context, ops *lilliput.ImageOps, img *Image, buffer []byte) error {
+	imgOpts := img.ImageOptions
+	_, lossy := QualityOptions[imgOpts.ImageType]
+	searchQuality := lossy && p.TargetQuality > 0
+	watermark := imgOpts.Watermark && p.Watermark != nil
+	if !searchQuality && !watermark {
+		return p.transform(ops, img, buffer)
+	}
+
+	reference, err := p.resizeToReference(ops, img, buffer)
+	if err != nil {
+		return err
+	}
+	if watermark {
+		if reference, err = p.Watermark.Apply(reference); err != nil {
+			return err
+		}
+	}
+	if searchQuality {
+		return p.searchQuality(ctx, ops, img, reference, buffer)
+	}
+
+	result, err := p.encodeReference(ops, reference, imgOpts.ImageType, EncodeOptions[imgOpts.ImageType], buffer)
+	if err != nil {
+		return err
+	}
+	img.Result.Buffer = &result
+	return nil
+}
+
+// Transform the image using the static EncodeOptions
+func (p *ImageProcessor) transform(ops *lilliput.ImageOps, img *Image, buffer []byte) error {
+	imgOpts := img.ImageOptions
+	opts := &lilliput.ImageOptions{
+		FileType:      "." + imgOpts.ImageType,
+		Width:         imgOpts.Width,
+		Height:        imgOpts.Height,
+		ResizeMethod:  resizeMethod(imgOpts),
+		EncodeOptions: EncodeOptions[imgOpts.ImageType],
+	}
+	resultBuffer, err := ops.Transform(*img.Data, opts, buffer)
+	ops.Clear()
+	if err != nil {
+		return err
+	}
+	img.Result.Buffer = &resultBuffer
+	return nil
+}
+
+// Resize the image into a lossless png which doesn't share memory with buffer
+func (p *ImageProcessor) resizeToReference(ops *lilliput.ImageOps, img *Image, buffer []byte) ([]byte, error) {
+	imgOpts := img.ImageOptions
+	reference, err := ops.Transform(*img.Data, &lilliput.ImageOptions{
+		FileType:      "." + ImageTypePng,
+		Width:         imgOpts.Width,
+		Height:        imgOpts.Height,
+		ResizeMethod:  resizeMethod(imgOpts),
+		EncodeOptions: map[int]int{lilliput.PngCompression: 1}, // it's thrown away, be fast
+	}, buffer)
+	ops.Clear()
+	if err != nil {
+		return nil, err
+	}
+	// buffer is reused by the next encodes, keep the reference on its own
+	return append([]byte(nil), reference...), nil
+}
+
+/*
+Binary-search the encoder quality, looking for the lowest quality which still
+reaches the target SSIM score against the reference. The search is capped by
+MaxQualityIterations, if no candidate reaches the target the best tried one wins.
+*/
+func (p *ImageProcessor) searchQuality(ctx context.Context, ops *lilliput.ImageOps, img *Image, reference []byte, buffer []byte) error {
+	imageType := img.ImageOptions.ImageType
+	referenceImage, err := png.Decode(bytes.NewReader(reference))
+	if err != nil {
+		return fmt.Errorf("%v: %v", ErrQualitySearchFailed, err)
+	}
+
+	var best []byte
+	bestQuality, bestScore := 0, -1.0
+	low, high := MinSearchQuality, MaxSearchQuality
+	for i := 0; i < p.MaxQualityIterations && low <= high; i++ {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%v: %w", ErrQualitySearchFailed, ctx.Err())
+		}
+		quality := (low + high) / 2
+		candidate, err := p.encodeReference(ops, reference, imageType, map[int]int{QualityOptions[imageType]: quality}, buffer)
+		if err != nil {
+			return err
+		}
+		candidateImage, _, err := image.Decode(bytes.NewReader(candidate))
+		if err != nil {
+			return fmt.Errorf("%v: %v", ErrQualitySearchFailed, err)
+		}
+		score, err := util.SSIM(referenceImage, candidateImage)
+		if err != nil {
+			return fmt.Errorf("%v: %v", ErrQualitySearchFailed, err)
+		}
+
+		if score >= p.TargetQuality {
+			// good enough, try to shave more bytes off
+			best, bestQuality, bestScore = append(best[:0], candidate...), quality, score
+			high = quality - 1
+		} else {
+			if bestScore < p.TargetQuality && score > bestScore {
+				best, bestQuality, bestScore = append(best[:0], candidate...), quality, score
 			}
-			image.Result.Cancel()
+			low = quality + 1
 		}
 	}
+
+	if best == nil {
+		return fmt.Errorf("%v: no candidate encoded", ErrQualitySearchFailed)
+	}
+	img.Result.Buffer = &best
+	img.Result.Quality = bestQuality
+	return nil
+}
+
+// Re-encode the png reference without resizing it
+func (p *ImageProcessor) encodeReference(ops *lilliput.ImageOps, reference []byte, imageType string, encodeOptions map[int]int, buffer []byte) ([]byte, error) {
+	decoder, err := lilliput.NewDecoder(reference)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	result, err := ops.Transform(decoder, &lilliput.ImageOptions{
+		FileType:      "." + imageType,
+		ResizeMethod:  lilliput.ImageOpsNoResize,
+		EncodeOptions: encodeOptions,
+	}, buffer)
+	ops.Clear()
+	return result, err
 }
@@ -1,10 +1,19 @@
 package processor
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/aperture147/mediaproxy/util"
 	"github.com/discord/lilliput"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -27,7 +36,7 @@ func TestImageProcessor(t *testing.T) {
 		t.Fatal("cannot decode image 1")
 	}
 
-	image, err := p.AddImage(&data, &ImageOptions{
+	image, err := p.AddImage(context.Background(), &data, &ImageOptions{
 		ImageType: ImageTypeJpeg,
 		Width:     150,
 		Height:    150,
@@ -41,8 +50,8 @@ func TestImageProcessor(t *testing.T) {
 	case <-time.After(5 * time.Second):
 		t.Fatal("overslept")
 	case <-image.Done():
-		if image.TransformationError != nil {
-			t.Fatal(image.TransformationError)
+		if image.Error != nil {
+			t.Fatal(image.Error)
 		}
 		err = ioutil.WriteFile(fmt.Sprintf("%d.jpeg", time.Now().UnixNano()), *image.Buffer, 0755)
 		if err != nil {
@@ -71,7 +80,7 @@ func TestImageProcessorInterrupted(t *testing.T) {
 		t.Fatal("cannot decode image 1")
 	}
 
-	image, err := p.AddImage(&data, &ImageOptions{
+	image, err := p.AddImage(context.Background(), &data, &ImageOptions{
 		ImageType: ImageTypeJpeg,
 		Width:     150,
 		Height:    150,
@@ -87,8 +96,12 @@ func TestImageProcessorInterrupted(t *testing.T) {
 	case <-time.After(5 * time.Second):
 		t.Fatal("overslept")
 	case <-image.Done():
-		if image.TransformationError != nil {
-			t.Fatal(image.TransformationError)
+		if errors.Is(image.Error, ErrShuttingDown) {
+			// cancelled before a worker picked it
+			return
+		}
+		if image.Error != nil {
+			t.Fatal(image.Error)
 		}
 		err = ioutil.WriteFile(fmt.Sprintf("%d.jpeg", time.Now().UnixNano()), *image.Buffer, 0755)
 		if err != nil {
@@ -96,3 +109,239 @@ func TestImageProcessorInterrupted(t *testing.T) {
 		}
 	}
 }
+
+// Generate a noisy gradient, flat images would reach any SSIM target at the lowest quality
+func generateTestImage(t testing.TB, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8((x * y) % 251),
+				A: 255,
+			})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageProcessorTargetQuality(t *testing.T) {
+	p := NewImageProcessor(context.Background(), ImageProcessorOptions{
+		MaxImageSize:  1024,
+		Routines:      1,
+		TargetQuality: 0.95,
+	})
+	defer p.Cancel()
+
+	data, err := lilliput.NewDecoder(generateTestImage(t, 512, 512))
+	if err != nil {
+		t.Fatal("cannot decode generated image")
+	}
+
+	image, err := p.AddImage(context.Background(), &data, &ImageOptions{
+		ImageType: ImageTypeJpeg,
+		Width:     256,
+		Height:    256,
+		Resize:    true,
+	})
+	if err != nil {
+		t.Fatal("cannot add generated image")
+	}
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("overslept")
+	case <-image.Done():
+		if image.Error != nil {
+			t.Fatal(image.Error)
+		}
+		if image.Quality < MinSearchQuality || image.Quality > MaxSearchQuality {
+			t.Fatalf("quality %d out of search range", image.Quality)
+		}
+		if len(*image.Buffer) == 0 {
+			t.Fatal("empty result")
+		}
+	}
+}
+
+func TestImageProcessorMaxQualityIterationsDefault(t *testing.T) {
+	for _, iterations := range []int{0, -1} {
+		p := NewImageProcessor(context.Background(), ImageProcessorOptions{TargetQuality: 0.95, MaxQualityIterations: iterations})
+		p.Cancel()
+		if p.MaxQualityIterations != DefaultMaxQualityIterations {
+			t.Fatalf("%d iterations: expected the default, got %d", iterations, p.MaxQualityIterations)
+		}
+	}
+}
+
+// Random RGBA pixels, nothing compresses them so the lossless output outgrows the raw size
+func generateNoisyPng(t testing.TB, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageProcessorBufferRetry(t *testing.T) {
+	p := NewImageProcessor(context.Background(), ImageProcessorOptions{
+		Routines: 1,
+		// the first buffer is the 16KiB class, too small for the png below
+		Buffers: util.NewBufferPool(4*1024, util.MiB),
+	})
+	defer p.Cancel()
+
+	result, err := p.AddImageBuffer(context.Background(), generateNoisyPng(t, 64, 64), &ImageOptions{
+		ImageType: ImageTypePng,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("overslept")
+	case <-result.Done():
+	}
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(*result.Buffer) <= 64*64*4 {
+		t.Fatalf("expected an output larger than the first buffer, got %d bytes", len(*result.Buffer))
+	}
+}
+
+// Transform the same image concurrently, each goroutine has its own ops
+func benchmarkImageTransform(b *testing.B, getBuffer func() []byte, putBuffer func([]byte)) {
+	input := generateTestImage(b, 1024, 1024)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ops := lilliput.NewImageOps(DefaultMaxImageSize)
+		defer ops.Close()
+		for pb.Next() {
+			decoder, err := lilliput.NewDecoder(input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			buffer := getBuffer()
+			_, err = ops.Transform(decoder, &lilliput.ImageOptions{
+				FileType:      ".jpeg",
+				Width:         256,
+				Height:        256,
+				ResizeMethod:  lilliput.ImageOpsFit,
+				EncodeOptions: EncodeOptions[ImageTypeJpeg],
+			}, buffer)
+			putBuffer(buffer)
+			ops.Clear()
+			decoder.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+}
+
+func BenchmarkImageTransformFreshBuffer(b *testing.B) {
+	benchmarkImageTransform(b, func() []byte {
+		return make([]byte, DefaultImageBufferSize*util.MiB)
+	}, func([]byte) {})
+}
+
+func BenchmarkImageTransformPooledBuffer(b *testing.B) {
+	pool := util.NewBufferPool(util.DefaultMinBufferSize, util.DefaultMaxBufferSize)
+	benchmarkImageTransform(b, func() []byte {
+		return pool.Get(1024 * 1024 * 4)
+	}, pool.Put)
+}
+
+// Solid png, its resized output keeps the exact same color
+func generateSolidPng(t testing.TB, width, height int, c color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+/*
+Push images of different sizes and colors through many workers at once, a worker
+writing into the framebuffers of another one shows up as a wrong size or a wrong color.
+*/
+func TestImageProcessorConcurrentTransforms(t *testing.T) {
+	const routines, jobs = 8, 96
+	p := NewImageProcessor(context.Background(), ImageProcessorOptions{
+		MaxImageSize: 1024,
+		Routines:     routines,
+		QueueSize:    jobs,
+	})
+	defer p.Cancel()
+
+	type job struct {
+		width, height int
+		color         color.RGBA
+		result        *ImageResult
+	}
+	pending := make([]job, jobs)
+	for i := range pending {
+		j := job{
+			width:  64 + (i%7)*48,
+			height: 48 + (i%5)*64,
+			color:  color.RGBA{R: uint8(i * 37), G: uint8(255 - i*11), B: uint8(i * 5), A: 255},
+		}
+		result, err := p.AddImageBuffer(context.Background(), generateSolidPng(t, j.width*2, j.height*2, j.color), &ImageOptions{
+			ImageType: ImageTypePng,
+			Width:     j.width,
+			Height:    j.height,
+			Resize:    true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.result = result
+		pending[i] = j
+	}
+
+	for i, j := range pending {
+		select {
+		case <-time.After(30 * time.Second):
+			t.Fatal("overslept")
+		case <-j.result.Done():
+		}
+		if j.result.Error != nil {
+			t.Fatalf("image %d: %v", i, j.result.Error)
+		}
+		output, err := png.Decode(bytes.NewReader(*j.result.Buffer))
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		if size := output.Bounds().Size(); size.X != j.width || size.Y != j.height {
+			t.Fatalf("image %d: expected %dx%d, got %dx%d", i, j.width, j.height, size.X, size.Y)
+		}
+		for _, point := range []image.Point{{0, 0}, {j.width / 2, j.height / 2}, {j.width - 1, j.height - 1}} {
+			r, g, b, _ := output.At(point.X, point.Y).RGBA()
+			if uint8(r>>8) != j.color.R || uint8(g>>8) != j.color.G || uint8(b>>8) != j.color.B {
+				t.Fatalf("image %d: expected color %v at %v, got %d,%d,%d", i, j.color, point, r>>8, g>>8, b>>8)
+			}
+		}
+	}
+
+	if n := p.Ops.Len(); n > routines {
+		t.Fatalf("expected at most %d ops, got %d", routines, n)
+	}
+}
@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"github.com/discord/lilliput"
+	"sync"
+)
+
+/*
+lilliput ImageOps keep the decoded frames in their own framebuffers and can't be
+used by two goroutines at once, so every running image job takes one for itself.
+Idle ops are kept for the next jobs, up to one per worker, the extra ones are
+freed once they are given back.
+*/
+type OpsPool struct {
+	mutex sync.Mutex
+
+	// Max width and height of the framebuffers, see lilliput.NewImageOps
+	Size int
+
+	// Max number of idle ops kept around
+	limit int
+
+	free   []*lilliput.ImageOps
+	inUse  int
+	closed bool
+}
+
+func NewOpsPool(size, workers int) *OpsPool {
+	return &OpsPool{Size: size, limit: workers}
+}
+
+// Take idle ops or allocate new ones
+func (o *OpsPool) Get() *lilliput.ImageOps {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.inUse++
+	if n := len(o.free); n > 0 {
+		ops := o.free[n-1]
+		o.free[n-1] = nil
+		o.free = o.free[:n-1]
+		return ops
+	}
+	return lilliput.NewImageOps(o.Size)
+}
+
+// Give the ops back, they are freed when the pool is closed or already keeps enough of them
+func (o *OpsPool) Put(ops *lilliput.ImageOps) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.inUse--
+	if o.closed || len(o.free) >= o.limit {
+		ops.Close()
+		return
+	}
+	o.free = append(o.free, ops)
+}
+
+// Change the number of idle ops kept, shrinking frees the extra ones right away
+func (o *OpsPool) Resize(workers int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.limit = workers
+	o.trim(workers)
+}
+
+func (o *OpsPool) trim(n int) {
+	for len(o.free) > n {
+		last := len(o.free) - 1
+		o.free[last].Close()
+		o.free[last] = nil
+		o.free = o.free[:last]
+	}
+}
+
+// Number of ops allocated, idle and in use
+func (o *OpsPool) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.free) + o.inUse
+}
+
+// Free the idle ops, the ones still in use are freed when given back
+func (o *OpsPool) Close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.closed = true
+	o.trim(0)
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"github.com/discord/lilliput"
+	"testing"
+)
+
+func TestOpsPool(t *testing.T) {
+	pool := NewOpsPool(64, 2)
+	ops := []*lilliput.ImageOps{pool.Get(), pool.Get(), pool.Get()}
+	if n := pool.Len(); n != 3 {
+		t.Fatalf("expected 3 ops, got %d", n)
+	}
+
+	for _, o := range ops {
+		pool.Put(o)
+	}
+	// only one idle ops per worker is kept
+	if n := pool.Len(); n != 2 {
+		t.Fatalf("expected 2 idle ops, got %d", n)
+	}
+
+	pool.Resize(1)
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("expected 1 idle ops after shrinking, got %d", n)
+	}
+
+	held := pool.Get()
+	pool.Close()
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("expected only the held ops, got %d", n)
+	}
+	pool.Put(held)
+	if n := pool.Len(); n != 0 {
+		t.Fatalf("expected no ops after close, got %d", n)
+	}
+}
@@ -0,0 +1,343 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"runtime/debug"
+	"time"
+)
+
+// Default 3 routines to handle the job
+const DefaultRoutines = 3
+
+// is 10 too much?
+const DefaultPoolQueueSize = 10
+
+// Kind of media handled by each processor, also used as the pool names
+const (
+	KindImage = "image"
+	KindAudio = "audio"
+	KindSvg   = "svg"
+)
+
+var ErrJobPanicked = errors.New("job panicked")
+
+/*
+Unit of work run by a Pool. The embedded context is the one of the caller,
+the job is skipped when it's done before a worker picks the job.
+*/
+type Job interface {
+	context.Context
+
+	// Do the work, ctx is done when the caller went away or the job timeout is reached.
+	// Long running jobs should give up as soon as ctx is done
+	Process(ctx context.Context) error
+
+	// Signal the caller, called exactly once with the error of Process,
+	// or with the reason why the job didn't run
+	Complete(err error)
+}
+
+type Result struct {
+	// Error of the job, set before Done fires
+	Error error
+
+	// Buffer pointer that point to the processed data
+	Buffer *[]byte
+
+	// This is used to signal other goroutine
+	// which is waiting for the processed result
+	context.Context
+	// CancelFunc Shouldn't be called outside of the processor
+	Cancel context.CancelFunc
+}
+
+func newResult(buffer *[]byte) Result {
+	ctx, cancel := context.WithCancel(context.Background())
+	return Result{
+		Buffer:  buffer,
+		Context: ctx,
+		Cancel:  cancel,
+	}
+}
+
+// Set the error and wake up the caller, prefix names the kind of job in the error
+func (r *Result) complete(prefix string, err error) {
+	if err != nil {
+		r.Error = fmt.Errorf("%s: %w", prefix, err)
+	}
+	r.Cancel()
+}
+
+type PoolOptions struct {
+	// Used in logs
+	Name string
+
+	// Number of routines/threads should be run
+	Routines int
+
+	// Max number of jobs waiting to be processed
+	QueueSize int
+
+	// How long Add waits for room in a full queue before giving up
+	// with ErrQueueFull, 0 gives up right away
+	EnqueueTimeout time.Duration
+
+	// Max time a job may run, 0 lets jobs run until their caller goes away
+	JobTimeout time.Duration
+
+	// Low priority jobs waiting for longer than this are run first,
+	// 0 uses DefaultAgingThreshold, a negative value disables aging
+	AgingThreshold time.Duration
+
+	// Called once every worker returned, e.g. to free resources shared by the workers
+	OnStop func()
+
+	// Bounds of the worker count, Routines is the initial count
+	Autoscale AutoscaleOptions
+
+	// Called with the new worker count when workers are added or stopped
+	OnScale func(workers int)
+
+	// A worker running the same job for longer than this is wedged, see CheckHealth.
+	// 0 uses twice the JobTimeout, or DefaultWedgedAfter without a JobTimeout
+	WedgedAfter time.Duration
+}
+
+// Worker pool shared by every processor, the processors only provide the jobs
+type Pool struct {
+	// Priority queue, fair between the scheduling keys
+	Queue *JobQueue
+
+	// Make use of context pattern
+	// This is used for inter-process cancelling method
+	context.Context
+	Cancel context.CancelFunc
+
+	PoolOptions
+
+	state  *queueState
+	scaler *scaler
+}
+
+func NewPool(parentCtx context.Context, options PoolOptions) Pool {
+	ctx, cancel := func() (context.Context, context.CancelFunc) {
+		ctx := context.Background()
+		if parentCtx != nil {
+			ctx = parentCtx
+		}
+		return context.WithCancel(ctx)
+	}()
+	if options.Routines == 0 {
+		options.Routines = DefaultRoutines
+	}
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultPoolQueueSize
+	}
+	if options.AgingThreshold == 0 {
+		options.AgingThreshold = DefaultAgingThreshold
+	}
+	return Pool{
+		Queue:       NewJobQueue(options.QueueSize, options.AgingThreshold),
+		Context:     ctx,
+		Cancel:      cancel,
+		PoolOptions: options,
+		state:       newQueueState(),
+		scaler:      newScaler(options.Autoscale, options.Routines),
+	}
+}
+
+// Start the workers, the following calls do nothing
+func (p *Pool) Start() {
+	if !p.state.start() {
+		return
+	}
+	routines := p.scaler.clamp(p.Routines)
+	logging.Info("processor started", logging.Fields{"processor": p.Name, "routines": routines})
+	p.resize(routines)
+	p.state.run(p.autoscale)
+	go func() {
+		<-p.state.drained()
+		// workers stopped by the context, fail what they left in the queue
+		if p.state.close(p.closeQueue) {
+			p.failQueued()
+		}
+		if p.OnStop != nil {
+			p.OnStop()
+		}
+		logging.Info("processor stopped", logging.Fields{"processor": p.Name})
+	}()
+}
+
+/*
+Queue the job, waiting up to EnqueueTimeout for room in the queue.
+On error the job is not queued and Complete is never called.
+*/
+func (p *Pool) Add(job Job) error {
+	push := func() { p.push(job) }
+	select {
+	case <-p.state.shutdown:
+		return ErrShuttingDown
+	default:
+	}
+	if p.Err() != nil {
+		return ErrShuttingDown
+	}
+
+	// fast path, don't arm a timer when there is room in the queue
+	select {
+	case p.Queue.slots <- struct{}{}:
+		return p.state.push(p.Queue, push)
+	default:
+	}
+	if p.EnqueueTimeout <= 0 {
+		return ErrQueueFull
+	}
+
+	// wait without the lock, Shutdown must not wait for the producers
+	deadline, stop := enqueueDeadline(p.EnqueueTimeout)
+	defer stop()
+	select {
+	case p.Queue.slots <- struct{}{}:
+		return p.state.push(p.Queue, push)
+	case <-deadline:
+		return ErrQueueFull
+	case <-p.state.shutdown:
+		return ErrShuttingDown
+	case <-p.Done():
+		return ErrShuttingDown
+	case <-job.Done():
+		return job.Err()
+	}
+}
+
+func (p *Pool) push(job Job) {
+	p.Queue.push(job)
+	metrics.QueueDepth.WithLabelValues(p.Name).Inc()
+}
+
+func (p *Pool) pop() queuedJob {
+	queued := p.Queue.popQueued()
+	metrics.QueueDepth.WithLabelValues(p.Name).Dec()
+	return queued
+}
+
+func (p *Pool) QueueDepth() int {
+	return p.Queue.Len()
+}
+
+func (p *Pool) QueueCapacity() int {
+	return p.Queue.Cap()
+}
+
+// Must be called with the state locked, so no Add is pushing
+func (p *Pool) closeQueue() {
+	close(p.Queue.ready)
+	close(p.scaler.stopped)
+}
+
+// Fail the jobs left in a closed queue
+func (p *Pool) failQueued() {
+	for range p.Queue.ready {
+		p.pop().job.Complete(ErrShuttingDown)
+	}
+}
+
+// Process jobs until the pool stops or quit is closed by a scale down
+func (p *Pool) work(quit <-chan struct{}) {
+	for {
+		// select picks randomly, don't keep on processing jobs once cancelled or stopped
+		if p.Err() != nil {
+			return
+		}
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		select {
+		case <-p.Done():
+			return
+		case <-quit:
+			return
+		case _, ok := <-p.Queue.ready:
+			if !ok {
+				// drained by Shutdown
+				return
+			}
+			queued := p.pop()
+			metrics.QueueWait.WithLabelValues(p.Name).Observe(time.Since(queued.enqueued).Seconds())
+			p.traceQueueWait(queued)
+			id := p.jobStarted()
+			p.runJob(queued.job)
+			p.jobDone(id, time.Since(queued.enqueued))
+		}
+	}
+}
+
+// Span of the time the job spent in the queue, under the span of the caller
+func (p *Pool) traceQueueWait(queued queuedJob) {
+	_, span := tracing.Start(queued.job, "queue.wait",
+		trace.WithTimestamp(queued.enqueued),
+		trace.WithAttributes(attribute.String("processor", p.Name)),
+	)
+	span.End()
+}
+
+func (p *Pool) runJob(job Job) {
+	if job.Err() != nil {
+		// nobody is waiting for this job anymore
+		job.Complete(job.Err())
+		return
+	}
+	ctx, cancel := context.Context(job), context.CancelFunc(func() {})
+	if p.JobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(job, p.JobTimeout)
+	}
+	defer cancel()
+	job.Complete(p.process(ctx, job))
+}
+
+// Run the job, a panic fails the job instead of killing the whole server
+func (p *Pool) process(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrJobPanicked, r)
+			logging.Error("job panicked", err, logging.Fields{"processor": p.Name, "stack": string(debug.Stack())})
+		}
+	}()
+	return job.Process(ctx)
+}
+
+/*
+Stop accepting new jobs and wait for the workers to process the queued ones.
+When ctx is done first, the jobs still in the queue are failed with ErrShuttingDown
+and the jobs being processed are left to finish on their own.
+*/
+func (p *Pool) Shutdown(ctx context.Context) error {
+	if !p.state.close(p.closeQueue) {
+		return ErrShuttingDown
+	}
+
+	var err error
+	select {
+	case <-p.state.drained():
+		p.Cancel()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// only left when the workers were cancelled or ctx is done
+	p.failQueued()
+	if err != nil {
+		logging.Warn("processor shut down before draining", err, logging.Fields{"processor": p.Name})
+	} else {
+		logging.Info("processor shut down", logging.Fields{"processor": p.Name})
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type funcJob struct {
+	context.Context
+	process func(ctx context.Context) error
+	result  Result
+}
+
+func newFuncJob(process func(ctx context.Context) error) *funcJob {
+	return &funcJob{
+		Context: context.Background(),
+		process: process,
+		result:  newResult(nil),
+	}
+}
+
+func (j *funcJob) Process(ctx context.Context) error {
+	return j.process(ctx)
+}
+
+func (j *funcJob) Complete(err error) {
+	j.result.complete("test", err)
+}
+
+func waitJob(t *testing.T, j *funcJob) error {
+	select {
+	case <-j.result.Done():
+		return j.result.Error
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never completed")
+		return nil
+	}
+}
+
+func TestPoolRecoversPanic(t *testing.T) {
+	p := NewPool(nil, PoolOptions{Name: "test", Routines: 1})
+	p.Start()
+	defer p.Cancel()
+
+	panicking := newFuncJob(func(ctx context.Context) error {
+		panic("boom")
+	})
+	if err := p.Add(panicking); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitJob(t, panicking); !errors.Is(err, ErrJobPanicked) {
+		t.Fatalf("expected ErrJobPanicked, got %v", err)
+	}
+
+	// the worker survived the panic
+	ok := newFuncJob(func(ctx context.Context) error { return nil })
+	if err := p.Add(ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitJob(t, ok); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolJobTimeout(t *testing.T) {
+	p := NewPool(nil, PoolOptions{Name: "test", Routines: 1, JobTimeout: 20 * time.Millisecond})
+	p.Start()
+	defer p.Cancel()
+
+	slow := newFuncJob(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := p.Add(slow); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitJob(t, slow); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestPoolCancelFailsQueuedJobs(t *testing.T) {
+	p := NewPool(nil, PoolOptions{Name: "test", Routines: 1})
+
+	queued := newFuncJob(func(ctx context.Context) error { return nil })
+	if err := p.Add(queued); err != nil {
+		t.Fatal(err)
+	}
+	// no worker ever picks the job
+	p.Cancel()
+	p.Start()
+
+	if err := waitJob(t, queued); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	if err := p.Add(newFuncJob(nil)); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+}
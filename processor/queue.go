@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("processor queue is full")
+	ErrShuttingDown = errors.New("processor is shutting down")
+)
+
+// Implemented by every processor, lets callers shed load before the queue overflows
+type QueueStats interface {
+	// Number of jobs waiting in the queue
+	QueueDepth() int
+	// Max number of jobs the queue can hold
+	QueueCapacity() int
+}
+
+// Context of the caller of an Add function, nil means the job can't be cancelled by the caller
+func jobContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// Timer bounding how long Add functions wait for room in the queue, timeout must be positive
+func enqueueDeadline(timeout time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(timeout)
+	return timer.C, func() { timer.Stop() }
+}
+
+/*
+Shutdown state of a processor. Processors are passed around by value,
+so the state lives behind a pointer shared by every copy.
+Add functions hold the read lock while pushing, so the queue is never
+closed under their feet. They wait for room without it, on shutdown as well,
+so closing the queue doesn't wait for them.
+*/
+type queueState struct {
+	sync.RWMutex
+	started  bool
+	closed   bool
+	shutdown chan struct{} // closed right before the queue is
+	workers  sync.WaitGroup
+}
+
+func newQueueState() *queueState {
+	return &queueState{shutdown: make(chan struct{})}
+}
+
+// Only the first call returns true
+func (s *queueState) start() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.started {
+		return false
+	}
+	s.started = true
+	return true
+}
+
+// Run a worker and keep track of it until it returns
+func (s *queueState) run(worker func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		worker()
+	}()
+}
+
+// Mark the queue as closed and call closeQueue, only the first call returns true
+func (s *queueState) close(closeQueue func()) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	close(s.shutdown)
+	closeQueue()
+	return true
+}
+
+/*
+Push with the read lock held, unless the queue was closed meanwhile.
+The caller took a slot of the queue, it's given back when the push is refused.
+*/
+func (s *queueState) push(q *JobQueue, push func()) error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		<-q.slots
+		return ErrShuttingDown
+	}
+	push()
+	return nil
+}
+
+// Closed once every worker has returned
+func (s *queueState) drained() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	return done
+}
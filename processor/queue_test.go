@@ -0,0 +1,136 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAddSvgQueueFull(t *testing.T) {
+	// nothing runs the processor, so the queue never drains
+	p := NewSvgProcessor(nil, SvgProcessorOptions{QueueSize: 1, EnqueueTimeout: 10 * time.Millisecond})
+	defer p.Cancel()
+
+	data := []byte("<svg></svg>")
+	if _, err := p.AddSvg(&data); err != nil {
+		t.Fatalf("first add failed: %v", err)
+	}
+	if p.QueueDepth() != 1 || p.QueueCapacity() != 1 {
+		t.Fatalf("unexpected queue stats %d/%d", p.QueueDepth(), p.QueueCapacity())
+	}
+
+	start := time.Now()
+	if _, err := p.AddSvg(&data); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("add gave up before the enqueue timeout")
+	}
+}
+
+func TestAddSvgQueueFullDefaultOptions(t *testing.T) {
+	// no enqueue timeout, a full queue is reported right away
+	p := NewSvgProcessor(nil, SvgProcessorOptions{})
+	defer p.Cancel()
+
+	data := []byte("<svg></svg>")
+	for i := 0; i < p.QueueCapacity(); i++ {
+		if _, err := p.AddSvg(&data); err != nil {
+			t.Fatalf("add %d failed: %v", i, err)
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := p.AddSvg(&data)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("expected ErrQueueFull, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add blocked on a full queue")
+	}
+}
+
+func TestSvgProcessorShutdown(t *testing.T) {
+	p := NewSvgProcessor(nil, SvgProcessorOptions{Routines: 2})
+	defer p.Cancel()
+
+	var results []*SvgResult
+	for i := 0; i < 3; i++ {
+		data := []byte(`<svg xmlns="http://www.w3.org/2000/svg">  <rect width="10" height="10"/>  </svg>`)
+		result, err := p.AddSvg(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	p.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		select {
+		case <-result.Done():
+		default:
+			t.Fatalf("svg %d was not processed before the shutdown returned", i)
+		}
+		if result.Error != nil {
+			t.Fatalf("svg %d: %v", i, result.Error)
+		}
+	}
+
+	data := []byte("<svg></svg>")
+	if _, err := p.AddSvg(&data); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	if err := p.Shutdown(ctx); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected a second shutdown to fail, got %v", err)
+	}
+}
+
+func TestSvgProcessorShutdownWaitingAdd(t *testing.T) {
+	// nothing runs the processor, the second add waits for room
+	p := NewSvgProcessor(nil, SvgProcessorOptions{QueueSize: 1, EnqueueTimeout: time.Minute})
+	defer p.Cancel()
+
+	data := []byte("<svg></svg>")
+	if _, err := p.AddSvg(&data); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := p.AddSvg(&data)
+		waiting <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+	for _, c := range []struct {
+		name   string
+		result chan error
+		err    error
+	}{
+		{"shutdown", shutdown, nil},
+		{"waiting add", waiting, ErrShuttingDown},
+	} {
+		select {
+		case err := <-c.result:
+			if !errors.Is(err, c.err) {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.err, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s blocked behind the enqueue timeout", c.name)
+		}
+	}
+}
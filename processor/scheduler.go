@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	PriorityLow = iota
+	PriorityNormal
+	PriorityHigh
+
+	priorityLevels
+)
+
+// Name of the priorities, as accepted by ParsePriority
+var PriorityNames = map[string]int{
+	"low":    PriorityLow,
+	"normal": PriorityNormal,
+	"high":   PriorityHigh,
+}
+
+// A job waiting for longer than this is run before the higher priority ones
+const DefaultAgingThreshold = 5 * time.Second
+
+// Context key of the job Scheduling
+const SchedulingKey = "scheduling"
+
+func ParsePriority(name string) (int, bool) {
+	priority, ok := PriorityNames[name]
+	return priority, ok
+}
+
+type Scheduling struct {
+	Priority int
+
+	// Jobs of the same priority are taken in turn from each key (e.g. tenant),
+	// so a bulk import doesn't delay the uploads of everybody else
+	Key string
+}
+
+// Attach the scheduling of the job to the context given to the Add functions
+func WithScheduling(ctx context.Context, s Scheduling) context.Context {
+	return context.WithValue(ctx, SchedulingKey, s)
+}
+
+// Normal priority, empty key when the context has no scheduling
+func SchedulingFromContext(ctx context.Context) Scheduling {
+	if s, ok := ctx.Value(SchedulingKey).(Scheduling); ok {
+		if s.Priority < PriorityLow {
+			s.Priority = PriorityLow
+		} else if s.Priority > PriorityHigh {
+			s.Priority = PriorityHigh
+		}
+		return s
+	}
+	return Scheduling{Priority: PriorityNormal}
+}
+
+type queuedJob struct {
+	job      Job
+	enqueued time.Time
+}
+
+// Jobs of a single priority, one FIFO per key served round robin
+type fairQueue struct {
+	keys []string
+	jobs map[string][]queuedJob
+	next int
+}
+
+func (q *fairQueue) push(key string, job queuedJob) {
+	if len(q.jobs[key]) == 0 {
+		q.keys = append(q.keys, key)
+	}
+	q.jobs[key] = append(q.jobs[key], job)
+}
+
+// Index of the key holding the oldest job, -1 when empty
+func (q *fairQueue) oldest() int {
+	index := -1
+	for i, key := range q.keys {
+		if index == -1 || q.jobs[key][0].enqueued.Before(q.jobs[q.keys[index]][0].enqueued) {
+			index = i
+		}
+	}
+	return index
+}
+
+func (q *fairQueue) pop(index int) queuedJob {
+	key := q.keys[index]
+	jobs := q.jobs[key]
+	job := jobs[0]
+	jobs[0] = queuedJob{}
+	if len(jobs) == 1 {
+		delete(q.jobs, key)
+		q.keys = append(q.keys[:index], q.keys[index+1:]...)
+	} else {
+		q.jobs[key] = jobs[1:]
+		index++
+	}
+	q.next = 0
+	if len(q.keys) > 0 {
+		q.next = index % len(q.keys)
+	}
+	return job
+}
+
+/*
+Bounded queue replacing the plain FIFO channel of the processors. The highest
+priority goes first, keys of the same priority are served in turn, and a job
+waiting for longer than AgingThreshold goes before everything else so low
+priority work is never starved.
+
+slots holds a token per queued job and bounds the queue, ready holds a token
+per job which can be popped, so both Add and the workers can keep on using select.
+*/
+type JobQueue struct {
+	AgingThreshold time.Duration
+
+	mutex  sync.Mutex
+	levels [priorityLevels]fairQueue
+	size   int
+
+	slots chan struct{}
+	ready chan struct{}
+}
+
+func NewJobQueue(capacity int, agingThreshold time.Duration) *JobQueue {
+	q := &JobQueue{
+		AgingThreshold: agingThreshold,
+		slots:          make(chan struct{}, capacity),
+		ready:          make(chan struct{}, capacity),
+	}
+	for i := range q.levels {
+		q.levels[i].jobs = make(map[string][]queuedJob)
+	}
+	return q
+}
+
+// Number of queued jobs
+func (q *JobQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+func (q *JobQueue) Cap() int {
+	return cap(q.slots)
+}
+
+// Queue the job, a slot must have been taken first
+func (q *JobQueue) push(job Job) {
+	s := SchedulingFromContext(job)
+	q.mutex.Lock()
+	q.levels[s.Priority].push(s.Key, queuedJob{job: job, enqueued: time.Now()})
+	q.size++
+	q.mutex.Unlock()
+	q.ready <- struct{}{}
+}
+
+// How long the oldest queued job has been waiting, 0 when the queue is empty
+func (q *JobQueue) OldestWait() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var oldest time.Time
+	for l := range q.levels {
+		if i := q.levels[l].oldest(); i != -1 {
+			enqueued := q.levels[l].jobs[q.levels[l].keys[i]][0].enqueued
+			if oldest.IsZero() || enqueued.Before(oldest) {
+				oldest = enqueued
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Take the next job, a ready token must have been taken first
+func (q *JobQueue) pop() Job {
+	return q.popQueued().job
+}
+
+func (q *JobQueue) popQueued() queuedJob {
+	q.mutex.Lock()
+	defer func() {
+		q.size--
+		q.mutex.Unlock()
+		<-q.slots
+	}()
+
+	if q.AgingThreshold > 0 {
+		// the oldest job waiting for too long, whatever its priority
+		now := time.Now()
+		level, index := -1, -1
+		for l := range q.levels {
+			i := q.levels[l].oldest()
+			if i == -1 {
+				continue
+			}
+			enqueued := q.levels[l].jobs[q.levels[l].keys[i]][0].enqueued
+			if now.Sub(enqueued) < q.AgingThreshold {
+				continue
+			}
+			if level == -1 || enqueued.Before(q.levels[level].jobs[q.levels[level].keys[index]][0].enqueued) {
+				level, index = l, i
+			}
+		}
+		if level != -1 {
+			return q.levels[level].pop(index)
+		}
+	}
+
+	for l := priorityLevels - 1; l >= 0; l-- {
+		if len(q.levels[l].keys) > 0 {
+			return q.levels[l].pop(q.levels[l].next)
+		}
+	}
+	return queuedJob{}
+}
@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func scheduledJob(priority int, key string) *funcJob {
+	job := newFuncJob(nil)
+	job.Context = WithScheduling(context.Background(), Scheduling{Priority: priority, Key: key})
+	return job
+}
+
+func pushJobs(q *JobQueue, jobs ...*funcJob) {
+	for _, job := range jobs {
+		q.slots <- struct{}{}
+		q.push(job)
+	}
+}
+
+func expectPopOrder(t *testing.T, q *JobQueue, jobs ...*funcJob) {
+	for i, expected := range jobs {
+		<-q.ready
+		if job := q.pop(); job != expected {
+			t.Fatalf("pop %d: expected %s, got %s", i,
+				SchedulingFromContext(expected).Key, SchedulingFromContext(job).Key)
+		}
+	}
+	if q.Len() != 0 {
+		t.Fatalf("%d jobs left in the queue", q.Len())
+	}
+}
+
+func TestJobQueuePriority(t *testing.T) {
+	q := NewJobQueue(10, time.Hour)
+	low, normal, high := scheduledJob(PriorityLow, "low"), scheduledJob(PriorityNormal, "normal"), scheduledJob(PriorityHigh, "high")
+	pushJobs(q, low, normal, high)
+	expectPopOrder(t, q, high, normal, low)
+}
+
+func TestJobQueueFairness(t *testing.T) {
+	q := NewJobQueue(10, time.Hour)
+	a1, a2, a3 := scheduledJob(PriorityNormal, "a1"), scheduledJob(PriorityNormal, "a2"), scheduledJob(PriorityNormal, "a3")
+	for _, job := range []*funcJob{a1, a2, a3} {
+		job.Context = WithScheduling(context.Background(), Scheduling{Priority: PriorityNormal, Key: "a"})
+	}
+	b := scheduledJob(PriorityNormal, "b")
+	// the bulk upload of a doesn't make b wait until it's over
+	pushJobs(q, a1, a2, a3, b)
+	expectPopOrder(t, q, a1, b, a2, a3)
+}
+
+func TestJobQueueAging(t *testing.T) {
+	q := NewJobQueue(10, 10*time.Millisecond)
+	low := scheduledJob(PriorityLow, "low")
+	pushJobs(q, low)
+	time.Sleep(20 * time.Millisecond)
+	high := scheduledJob(PriorityHigh, "high")
+	pushJobs(q, high)
+	expectPopOrder(t, q, low, high)
+}
@@ -2,97 +2,95 @@ package processor
 
 import (
 	"context"
-	"fmt"
 	"github.com/aperture147/mediaproxy/util"
-	"log"
+	"time"
 )
 
-type SvgResult struct {
-	// Object that contains the SVG minify error
-	ConvertError error
-
-	// Buffer pointer that point to the SVG
-	Buffer *[]byte
+// is 10 too much?
+const DefaultSvgQueueSize = 10
 
-	// This is used to signal other goroutine
-	// which is waiting for the processed result
-	context.Context
-	// CancelFunc Shouldn't be called outside of the processor
-	Cancel context.CancelFunc
+type SvgResult struct {
+	// Error wraps the SVG minify error
+	Result
 }
 
 type Svg struct {
+	// Context of the caller, the svg is skipped once it's done
+	context.Context
+
 	Data   *[]byte
 	Result *SvgResult
 }
 
+func (svg *Svg) Process(ctx context.Context) error {
+	result, err := util.MinifySvg(svg.Data)
+	if err != nil {
+		return err
+	}
+	svg.Result.Buffer = result
+	return nil
+}
+
+func (svg *Svg) Complete(err error) {
+	svg.Result.complete("svg", err)
+}
+
 type SvgProcessorOptions struct {
 	// Number of routines/threads should be run
 	Routines int
-}
 
-type SvgProcessor struct {
-	Queue chan *Svg
+	// Max number of SVG files waiting to be processed
+	QueueSize int
 
-	// Make use of context pattern
-	// This is used for inter-process cancelling method
-	context.Context
-	Cancel context.CancelFunc
+	// How long AddSvg waits for room in a full queue before giving up
+	// with ErrQueueFull, 0 gives up right away
+	EnqueueTimeout time.Duration
 
-	SvgProcessorOptions
+	// Max time spent on a single SVG, 0 disables the timeout
+	JobTimeout time.Duration
+
+	// Low priority SVG files waiting for longer than this go first,
+	// 0 uses DefaultAgingThreshold, a negative value disables aging
+	AgingThreshold time.Duration
+
+	// Bounds of the worker count, Routines is the initial count
+	Autoscale AutoscaleOptions
 }
 
+type SvgProcessor struct {
+	Pool
+}
+
+// The workers are not started, call Start
 func NewSvgProcessor(parentCtx context.Context, options SvgProcessorOptions) SvgProcessor {
-	ctx, cancel := func() (context.Context, context.CancelFunc) {
-		ctx := context.Background()
-		if parentCtx != nil {
-			ctx = parentCtx
-		}
-		return context.WithCancel(ctx)
-	}()
 	return SvgProcessor{
-		Context: ctx,
-		Cancel:  cancel,
-		Queue:   make(chan *Svg, 10), // is 10 too much?
-		SvgProcessorOptions: SvgProcessorOptions{
-			Routines: func() int {
-				if options.Routines != 0 {
-					return options.Routines
+		Pool: NewPool(parentCtx, PoolOptions{
+			Name:     KindSvg,
+			Routines: options.Routines,
+			QueueSize: func() int {
+				if options.QueueSize != 0 {
+					return options.QueueSize
 				}
-				return DefaultRoutines
+				return DefaultSvgQueueSize
 			}(),
-		},
+			EnqueueTimeout: options.EnqueueTimeout,
+			JobTimeout:     options.JobTimeout,
+			AgingThreshold: options.AgingThreshold,
+			Autoscale:      options.Autoscale,
+		}),
 	}
 }
 
 func (p *SvgProcessor) AddSvg(data *[]byte) (*SvgResult, error) {
-	ctx, err := context.WithCancel(context.Background())
-	result := &SvgResult{
-		Buffer:  data,
-		Context: ctx,
-		Cancel:  err,
+	result := &SvgResult{Result: newResult(data)}
+	job := &Svg{
+		Context: context.Background(),
+		Data:    data,
+		Result:  result,
 	}
-	p.Queue <- &Svg{
-		Data:   data,
-		Result: result,
+	if err := p.Add(job); err != nil {
+		result.Cancel()
+		return nil, err
 	}
 	return result, nil
 }
-
-func (p *SvgProcessor) Run() {
-	for {
-		select {
-		case <-p.Done():
-			log.Println("Svg Processor stopped")
-			return
-		case svg := <-p.Queue:
-			result, err := util.MinifySvg(svg.Data)
-			if err != nil {
-				svg.Result.ConvertError = fmt.Errorf("svg: %v", err)
-				continue
-			}
-			svg.Result.Buffer = result
-			svg.Result.Cancel()
-		}
-	}
-}
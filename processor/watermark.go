@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	GravityNorthWest = "northwest"
+	GravityNorth     = "north"
+	GravityNorthEast = "northeast"
+	GravityWest      = "west"
+	GravityCenter    = "center"
+	GravityEast      = "east"
+	GravitySouthWest = "southwest"
+	GravitySouth     = "south"
+	GravitySouthEast = "southeast"
+)
+
+const (
+	DefaultWatermarkGravity = GravitySouthEast
+	// Watermark width relative to the output width
+	DefaultWatermarkScale   = 0.2
+	DefaultWatermarkOpacity = 1.0
+)
+
+// An overlay stamped onto the output image after it has been resized
+type Watermark struct {
+	// Overlay image, usually a png with transparency
+	Image image.Image
+
+	// Where the overlay is anchored, one of the Gravity constants
+	Gravity string
+
+	// Distance in pixels between the overlay and the anchored edges
+	Margin int
+
+	// Opacity of the overlay in (0, 1]
+	Opacity float64
+
+	// Overlay width relative to the output width in (0, 1],
+	// the overlay keeps its aspect ratio
+	Scale float64
+}
+
+// Zero values fall back to the defaults
+func NewWatermark(img image.Image, gravity string, margin int, opacity, scale float64) *Watermark {
+	if gravity == "" {
+		gravity = DefaultWatermarkGravity
+	}
+	if opacity <= 0 || opacity > 1 {
+		opacity = DefaultWatermarkOpacity
+	}
+	if scale <= 0 || scale > 1 {
+		scale = DefaultWatermarkScale
+	}
+	return &Watermark{
+		Image:   img,
+		Gravity: gravity,
+		Margin:  margin,
+		Opacity: opacity,
+		Scale:   scale,
+	}
+}
+
+// Load a png overlay from the disk
+func LoadWatermarkImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("watermark: %v", err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("watermark: %v", err)
+	}
+	return img, nil
+}
+
+// Compute the top left corner of the overlay inside the output
+func (wm *Watermark) position(dst, overlay image.Rectangle) image.Point {
+	left := dst.Min.X + wm.Margin
+	centerX := dst.Min.X + (dst.Dx()-overlay.Dx())/2
+	right := dst.Max.X - overlay.Dx() - wm.Margin
+	top := dst.Min.Y + wm.Margin
+	centerY := dst.Min.Y + (dst.Dy()-overlay.Dy())/2
+	bottom := dst.Max.Y - overlay.Dy() - wm.Margin
+
+	switch wm.Gravity {
+	case GravityNorthWest:
+		return image.Pt(left, top)
+	case GravityNorth:
+		return image.Pt(centerX, top)
+	case GravityNorthEast:
+		return image.Pt(right, top)
+	case GravityWest:
+		return image.Pt(left, centerY)
+	case GravityCenter:
+		return image.Pt(centerX, centerY)
+	case GravityEast:
+		return image.Pt(right, centerY)
+	case GravitySouthWest:
+		return image.Pt(left, bottom)
+	case GravitySouth:
+		return image.Pt(centerX, bottom)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+// Stamp the overlay onto dst
+func (wm *Watermark) Draw(dst draw.Image) {
+	bounds := dst.Bounds()
+	source := wm.Image.Bounds()
+	width := int(float64(bounds.Dx()) * wm.Scale)
+	height := width * source.Dy() / source.Dx()
+	if width == 0 || height == 0 {
+		// output too small to carry the overlay
+		return
+	}
+
+	overlay := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(overlay, overlay.Bounds(), wm.Image, source, draw.Src, nil)
+
+	at := wm.position(bounds, overlay.Bounds())
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.Opacity * 255)})
+	draw.DrawMask(dst, overlay.Bounds().Add(at), overlay, image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// Stamp the overlay onto a png encoded image and return the png encoded result
+func (wm *Watermark) Apply(buf []byte) ([]byte, error) {
+	decoded, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("watermark: %v", err)
+	}
+	canvas := image.NewRGBA(decoded.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	wm.Draw(canvas)
+
+	result := new(bytes.Buffer)
+	// the result is only an intermediate step, don't spend time on compression
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err = encoder.Encode(result, canvas); err != nil {
+		return nil, fmt.Errorf("watermark: %v", err)
+	}
+	return result.Bytes(), nil
+}
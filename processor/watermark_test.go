@@ -0,0 +1,30 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestWatermarkDraw(t *testing.T) {
+	logo := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// 20% of 100px wide -> 20x10 overlay at (5, 85)
+	wm := NewWatermark(logo, GravitySouthWest, 5, 0.5, 0)
+	wm.Draw(canvas)
+
+	stamped := canvas.RGBAAt(10, 90)
+	if stamped.R != 255 || stamped.G < 100 || stamped.G > 155 {
+		t.Fatalf("expected a half transparent red pixel, got %v", stamped)
+	}
+	for _, pt := range []image.Point{{4, 90}, {10, 84}, {26, 90}, {10, 96}, {95, 5}} {
+		if c := canvas.RGBAAt(pt.X, pt.Y); c != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+			t.Fatalf("pixel %v should be untouched, got %v", pt, c)
+		}
+	}
+}
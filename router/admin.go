@@ -0,0 +1,98 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/util"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+)
+
+const (
+	// Appended to the admin path to get the worker endpoints
+	WorkersPath  = "/workers"
+	ProcessorVar = "processor"
+)
+
+var ErrUnknownProcessor = errors.New("unknown processor")
+
+type AdminRouterSetting struct {
+	Path string // router path
+
+	// Authenticator of the operators, the principal needs middleware.ScopeAdmin.
+	// nil falls back to the static token authenticator, which never grants it
+	Authenticator middleware.Authenticator
+
+	// Processors created by the routers sharing this lifecycle can be tuned
+	Lifecycle *Lifecycle
+}
+
+type WorkerBoundsRequest struct {
+	MinWorkers int `json:"min_workers"`
+	MaxWorkers int `json:"max_workers"`
+}
+
+// Registered processors which can be scaled, by name
+func scalers(l *Lifecycle) map[string]processor.Scaler {
+	result := make(map[string]processor.Scaler)
+	if l == nil {
+		return result
+	}
+	for _, p := range l.Processors() {
+		if s, ok := p.(processor.Scaler); ok {
+			result[s.WorkerStatus().Name] = s
+		}
+	}
+	return result
+}
+
+/*
+Runtime tuning of the processors:
+GET {Path}/workers lists the worker count of every processor,
+PUT {Path}/workers/{processor} changes its worker bounds.
+*/
+func NewAdminRouter(setting AdminRouterSetting) *mux.Router {
+	auth := Setting{Authenticator: setting.Authenticator}.authenticator()
+	scope := middleware.NewScopeVerifier(middleware.ScopeAdmin)
+
+	r := mux.NewRouter()
+	r.Use(middleware.NewRequestLogger("admin").Handle, auth.Verify, scope.Verify)
+	r.HandleFunc(setting.Path+WorkersPath, func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]processor.WorkerStatus, 0)
+		for _, s := range scalers(setting.Lifecycle) {
+			statuses = append(statuses, s.WorkerStatus())
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+		util.WriteOkResponse(w, statuses)
+	}).Methods(http.MethodGet)
+
+	r.HandleFunc(setting.Path+WorkersPath+"/{"+ProcessorVar+"}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)[ProcessorVar]
+		s, ok := scalers(setting.Lifecycle)[name]
+		if !ok {
+			util.WriteErrorResponse(w, util.ErrCodeUnknownProcessor, ErrUnknownProcessor)
+			return
+		}
+
+		var req WorkerBoundsRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			util.WriteBadRequestResponse(w, fmt.Errorf("worker bounds: %v", err))
+			return
+		}
+		status, err := s.SetWorkerBounds(req.MinWorkers, req.MaxWorkers)
+		if errors.Is(err, processor.ErrShuttingDown) {
+			AddErrorResponseAndLog(w, r, "worker bounds", err)
+			return
+		}
+		if err != nil {
+			util.WriteBadRequestResponse(w, fmt.Errorf("worker bounds: %v", err))
+			return
+		}
+		util.WriteOkResponse(w, status)
+	}).Methods(http.MethodPut)
+	return r
+}
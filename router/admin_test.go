@@ -0,0 +1,73 @@
+package router
+
+import (
+	"encoding/json"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) (*httptest.ResponseRecorder, []processor.WorkerStatus) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []processor.WorkerStatus
+	if method == http.MethodGet {
+		json.Unmarshal(response.Data, &statuses)
+	} else {
+		var status processor.WorkerStatus
+		json.Unmarshal(response.Data, &status)
+		statuses = append(statuses, status)
+	}
+	return w, statuses
+}
+
+func TestAdminRouterWorkers(t *testing.T) {
+	p := processor.NewSvgProcessor(nil, processor.SvgProcessorOptions{Routines: 1})
+	p.Start()
+	defer p.Cancel()
+	lifecycle := NewLifecycle()
+	lifecycle.Register(&p)
+
+	admin := NewAdminRouter(AdminRouterSetting{
+		Path:          "/admin",
+		Authenticator: staticAuthenticator{&middleware.Principal{Subject: "ops", Scopes: []string{middleware.ScopeAdmin}}},
+		Lifecycle:     lifecycle,
+	})
+
+	w, statuses := adminRequest(t, admin, http.MethodGet, "/admin/workers", "")
+	if w.Code != http.StatusOK || len(statuses) != 1 || statuses[0].Name != processor.KindSvg {
+		t.Fatalf("unexpected workers %d %+v", w.Code, statuses)
+	}
+
+	w, statuses = adminRequest(t, admin, http.MethodPut, "/admin/workers/svg", `{"min_workers": 2, "max_workers": 2}`)
+	if w.Code != http.StatusOK || statuses[0].MinWorkers != 2 || statuses[0].MaxWorkers != 2 {
+		t.Fatalf("unexpected bounds %d %+v", w.Code, statuses)
+	}
+
+	if w, _ = adminRequest(t, admin, http.MethodPut, "/admin/workers/svg", `{"min_workers": 0}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid bounds, got %d", w.Code)
+	}
+	if w, _ = adminRequest(t, admin, http.MethodPut, "/admin/workers/video", `{"min_workers": 1, "max_workers": 1}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown processor, got %d", w.Code)
+	}
+}
+
+func TestAdminRouterNeedsScope(t *testing.T) {
+	admin := NewAdminRouter(AdminRouterSetting{
+		Path:          "/admin",
+		Authenticator: staticAuthenticator{&middleware.Principal{Subject: "tester", Scopes: []string{middleware.ScopeImageUpload}}},
+		Lifecycle:     NewLifecycle(),
+	})
+	if w, _ := adminRequest(t, admin, http.MethodGet, "/admin/workers", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
@@ -0,0 +1,280 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/journal"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tracing"
+	"github.com/aperture147/mediaproxy/util"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// Appended to the router path to get the async upload route, the job status
+	// is served at the same path followed by the job id
+	AsyncPath   = "/async"
+	AsyncJobVar = "id"
+
+	// Done and failed jobs are kept this long for their status to be read
+	DefaultAsyncRetention = 24 * time.Hour
+
+	// A result which can't be saved is retried, waiting twice as long each time, before failing the job
+	AsyncSaveAttempts          = 5
+	DefaultAsyncSaveRetryDelay = time.Second
+)
+
+type AsyncResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	Path   string `json:"path,omitempty"`
+	Url    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Set once done, jobs done before the metadata was journaled have none
+	*AssetMetadata
+}
+
+func getAsyncResponse(entry *journal.Entry) AsyncResponse {
+	response := AsyncResponse{
+		JobID:  entry.ID,
+		Status: entry.Status,
+		Error:  entry.Error,
+	}
+	if entry.Status == journal.StatusDone {
+		pathResponse := GetResponse(entry.Path)
+		response.Path, response.Url = pathResponse.Path, pathResponse.Url
+		var metadata AssetMetadata
+		if entry.Metadata != nil && json.Unmarshal(entry.Metadata, &metadata) == nil {
+			response.AssetMetadata = &metadata
+		}
+	}
+	return response
+}
+
+/*
+Runs the journaled uploads. The input and options of an async upload are
+persisted before it is accepted, the job is marked done only once its result
+is saved, so the pending jobs left by a crash are replayed on the next start.
+*/
+type asyncRunner struct {
+	Context context.Context
+	Journal *journal.Journal
+	Kind    string
+
+	// Storage of a replayed job
+	Storage func(entry *journal.Entry) storage.Storage
+
+	// Run the job through the processor and wait for its result, the metadata has at least the content type
+	Process func(ctx context.Context, entry *journal.Entry, data []byte) (*[]byte, AssetMetadata, error)
+
+	// Delay before the first save retry, 0 uses DefaultAsyncSaveRetryDelay
+	SaveRetryDelay time.Duration
+}
+
+func (s Setting) asyncStorage(entry *journal.Entry) storage.Storage {
+	if s.AsyncStorage != nil {
+		if st := s.AsyncStorage(entry.TenantID); st != nil {
+			return metrics.InstrumentStorage(st)
+		}
+	}
+	return metrics.InstrumentStorage(s.Storage)
+}
+
+// Journal the upload of the request, the returned entry is ready to be run
+func (a asyncRunner) append(r *http.Request, options interface{}, preset string, data []byte, scheduling processor.Scheduling) (*journal.Entry, error) {
+	entry := journal.Entry{
+		Kind:     a.Kind,
+		Preset:   preset,
+		Priority: scheduling.Priority,
+		FairKey:  scheduling.Key,
+	}
+	if options != nil {
+		raw, err := json.Marshal(options)
+		if err != nil {
+			return nil, err
+		}
+		entry.Options = raw
+	}
+	if p := middleware.PrincipalFromContext(r.Context()); p != nil {
+		entry.Owner = p.RateLimitKey()
+		entry.TenantID = p.TenantID
+		entry.StoragePrefix = p.StoragePath("")
+	}
+	return a.Journal.Append(entry, data)
+}
+
+func (a asyncRunner) run(entry *journal.Entry, data []byte, st storage.Storage) {
+	base := a.Context
+	if base == nil {
+		base = context.Background()
+	}
+	ctx := processor.WithScheduling(base, processor.Scheduling{Priority: entry.Priority, Key: entry.FairKey})
+	// the job outlives the request which accepted it, it gets a trace of its own
+	ctx, span := tracing.Start(ctx, "async."+a.Kind, trace.WithAttributes(attribute.String("job.id", entry.ID)))
+	defer span.End()
+	st = tracing.InstrumentStorage(ctx, st)
+	logger := a.logger(entry, len(data), span.SpanContext().TraceID().String())
+	start := time.Now()
+	elapsed := func() logging.Fields {
+		return logging.Fields{"duration_ms": time.Since(start).Milliseconds()}
+	}
+	for {
+		attempt := time.Now()
+		buf, metadata, err := a.Process(ctx, entry, data)
+		if errors.Is(err, processor.ErrQueueFull) {
+			// nobody waits on the other end, just try again later
+			select {
+			case <-time.After(QueueFullRetryAfter * time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if errors.Is(err, processor.ErrShuttingDown) || ctx.Err() != nil {
+			logger.Warn("async job left pending", err, elapsed())
+			return
+		}
+		if err != nil {
+			logger.Error("async job failed", err, elapsed())
+			if err = a.Journal.Fail(entry.ID, err); err != nil {
+				logger.Error("journal failed", err, elapsed())
+			}
+			return
+		}
+
+		hash := util.GetMd5String(buf)
+		savedPath, err := a.save(ctx, st, path.Join(entry.StoragePrefix, hash), metadata.ContentType, buf, logger)
+		if ctx.Err() != nil {
+			logger.Warn("async job left pending, save interrupted", err, elapsed())
+			return
+		}
+		if err != nil {
+			logger.Error("async job failed, save failed", err, elapsed())
+			if err = a.Journal.Fail(entry.ID, err); err != nil {
+				logger.Error("journal failed", err, elapsed())
+			}
+			return
+		}
+		metrics.ObserveCompression(a.Kind, len(data), len(*buf))
+		metadata.Preset = entry.Preset
+		metadata.setContent(len(data), buf, hash, attempt)
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			logger.Error("metadata not journaled", err, elapsed())
+			raw = nil
+		}
+		if err = a.Journal.Done(entry.ID, savedPath, raw); err != nil {
+			logger.Error("journal failed", err, elapsed())
+		}
+		return
+	}
+}
+
+// Save the result, retrying with a growing delay until AsyncSaveAttempts saves failed or ctx is done
+func (a asyncRunner) save(ctx context.Context, st storage.Storage, fileName, contentType string, buf *[]byte, logger *logging.Logger) (string, error) {
+	delay := a.SaveRetryDelay
+	if delay <= 0 {
+		delay = DefaultAsyncSaveRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		savedPath, err := st.Save(fileName, contentType, buf)
+		if err == nil || attempt == AsyncSaveAttempts {
+			return savedPath, err
+		}
+		logger.Warn("async save failed, retrying", err, logging.Fields{"attempt": attempt, "retry_in_ms": delay.Milliseconds()})
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// Fields of the log lines of a job, the job outlives its request so they come from the journal
+func (a asyncRunner) logger(entry *journal.Entry, fileSize int, traceID string) *logging.Logger {
+	fields := logging.Fields{
+		"router":    a.Kind,
+		"job_id":    entry.ID,
+		"subject":   entry.Owner,
+		"file_size": fileSize,
+		"trace_id":  traceID,
+	}
+	if entry.TenantID != "" {
+		fields["tenant_id"] = entry.TenantID
+	}
+	return logging.Default.With(fields)
+}
+
+// Run the pending jobs left by the previous process
+func (a asyncRunner) replay() {
+	fields := logging.Fields{"router": a.Kind}
+	if err := a.Journal.Prune(DefaultAsyncRetention); err != nil {
+		logging.Error("journal prune failed", err, fields)
+	}
+	entries, err := a.Journal.Pending(a.Kind)
+	if err != nil {
+		logging.Error("journal replay failed", err, fields)
+		return
+	}
+	if len(entries) > 0 {
+		logging.Info("replaying async jobs", logging.Fields{"router": a.Kind, "jobs": len(entries)})
+	}
+	for _, entry := range entries {
+		data, err := a.Journal.Data(entry.ID)
+		if err != nil {
+			a.Journal.Fail(entry.ID, err)
+			continue
+		}
+		go a.run(entry, data, a.Storage(entry))
+	}
+}
+
+/*
+Accept the upload once it's journaled, the job runs in the background.
+It keeps the in flight slot of the request until it's done, so the rate limiter
+bounds the queued jobs of a principal and not only its requests.
+*/
+func (a asyncRunner) accept(w http.ResponseWriter, r *http.Request, options interface{}, preset string, data []byte, scheduling processor.Scheduling, st storage.Storage) {
+	entry, err := a.append(r, options, preset, data, scheduling)
+	if err != nil {
+		ServerErrorResponseAndLog(w, r, "journal failed", err)
+		return
+	}
+	release := middleware.DetachInFlight(r.Context())
+	go func() {
+		defer release()
+		a.run(entry, data, st)
+	}()
+	w.Header().Set("Location", r.URL.Path+"/"+entry.ID)
+	util.WriteJsonResponse(w, http.StatusAccepted, "accepted", getAsyncResponse(entry))
+}
+
+// Status of an async upload, only visible to the principal which made it
+func (a asyncRunner) status(w http.ResponseWriter, r *http.Request) {
+	entry, err := a.Journal.Get(mux.Vars(r)[AsyncJobVar])
+	owner := ""
+	if p := middleware.PrincipalFromContext(r.Context()); p != nil {
+		owner = p.RateLimitKey()
+	}
+	if err != nil || entry.Kind != a.Kind || entry.Owner != owner {
+		util.WriteErrorResponse(w, util.ErrCodeJobNotFound, journal.ErrNotFound)
+		return
+	}
+	if entry.Status == journal.StatusPending {
+		w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+	}
+	util.WriteOkResponse(w, getAsyncResponse(entry))
+}
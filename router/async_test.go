@@ -0,0 +1,215 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/journal"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type staticAuthenticator struct {
+	principal *middleware.Principal
+}
+
+func (a staticAuthenticator) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(middleware.WithPrincipal(r.Context(), a.principal)))
+	})
+}
+
+func testPng(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func waitJournalEntry(t *testing.T, j *journal.Journal, id string) *journal.Entry {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		entry, err := j.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Status != journal.StatusPending {
+			return entry
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job never finished")
+	return nil
+}
+
+func TestImageRouterAsyncUpload(t *testing.T) {
+	j, err := journal.NewJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := storage.NewFileSystemStorage(t.TempDir())
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: s,
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject: "tester",
+				Scopes:  []string{middleware.ScopeImageUpload},
+			}},
+			Journal: j,
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+		TargetQuality:   0.95,
+	})
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="` + ImageFileField + `"; filename="test.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(testPng(t))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/image/upload"+AsyncPath, body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var accepted struct {
+		Data AsyncResponse `json:"data"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := waitJournalEntry(t, j, accepted.Data.JobID)
+	if entry.Status != journal.StatusDone {
+		t.Fatalf("job failed: %s", entry.Error)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/image/upload"+AsyncPath+"/"+entry.ID, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(entry.Path)) {
+		t.Fatalf("unexpected status response %d: %s", w.Code, w.Body.String())
+	}
+	var status struct {
+		Data AsyncResponse `json:"data"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if metadata := status.Data.AssetMetadata; metadata == nil || metadata.Hash == "" || metadata.Width == 0 || metadata.ContentType == "" || metadata.Quality == 0 {
+		t.Fatalf("missing metadata in %s", w.Body.String())
+	}
+}
+
+func TestImageRouterAsyncReplay(t *testing.T) {
+	j, err := journal.NewJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left pending by a previous process
+	options, _ := json.Marshal(processor.ImageOptions{ImageType: processor.ImageTypeJpeg, Width: 32, Height: 32, Resize: true})
+	entry, err := j.Append(journal.Entry{Kind: processor.KindImage, Options: options}, testPng(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := storage.NewFileSystemStorage(t.TempDir())
+	NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: s,
+			Path:    "/image/upload",
+			Journal: j,
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	})
+
+	entry = waitJournalEntry(t, j, entry.ID)
+	if entry.Status != journal.StatusDone {
+		t.Fatalf("replayed job failed: %s", entry.Error)
+	}
+	if _, err = j.Data(entry.ID); err == nil {
+		t.Fatal("input of the replayed job should be dropped")
+	}
+}
+
+// Storage failing its first saves, failures of them
+type flakyStorage struct {
+	failures int32
+	saves    int32
+}
+
+func (s *flakyStorage) Save(fileName, _ string, _ *[]byte) (string, error) {
+	if atomic.AddInt32(&s.saves, 1) <= s.failures {
+		return "", errors.New("storage unavailable")
+	}
+	return fileName, nil
+}
+
+func (s *flakyStorage) Load(string) (*[]byte, error) { return nil, storage.ErrNotFound }
+func (s *flakyStorage) Delete(string) error          { return nil }
+
+func TestAsyncRunnerSaveRetry(t *testing.T) {
+	j, err := journal.NewJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := asyncRunner{
+		Context: context.Background(),
+		Journal: j,
+		Kind:    processor.KindImage,
+		Process: func(ctx context.Context, entry *journal.Entry, data []byte) (*[]byte, AssetMetadata, error) {
+			return &data, AssetMetadata{ContentType: "image/png"}, nil
+		},
+		SaveRetryDelay: time.Millisecond,
+	}
+
+	for _, c := range []struct {
+		failures int32
+		status   string
+	}{
+		{AsyncSaveAttempts - 1, journal.StatusDone},
+		{AsyncSaveAttempts, journal.StatusFailed},
+	} {
+		entry, err := j.Append(journal.Entry{Kind: processor.KindImage}, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := &flakyStorage{failures: c.failures}
+		runner.run(entry, []byte("data"), st)
+		if entry, err = j.Get(entry.ID); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Status != c.status || st.saves != AsyncSaveAttempts {
+			t.Fatalf("%d failures: expected %s after %d saves, got %s after %d", c.failures, c.status, AsyncSaveAttempts, entry.Status, st.saves)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package router
 
 import (
+	"context"
+	"github.com/aperture147/mediaproxy/journal"
+	"github.com/aperture147/mediaproxy/metrics"
 	"github.com/aperture147/mediaproxy/processor"
 	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/tracing"
 	"github.com/aperture147/mediaproxy/util"
 	"github.com/gorilla/mux"
 	"net/http"
@@ -11,46 +15,103 @@ import (
 
 const AudioFileField = "audioFile"
 
+// Every audio file is converted to mp3
+const AudioContentType = "audio/mpeg"
+
+// Formats accepted by the audio upload, anything else never reaches ffmpeg
+var AudioFormats = []string{util.FormatMp3, util.FormatWav, util.FormatFlac, util.FormatOgg, util.FormatM4a}
+
 type AudioRouterSetting struct {
 	Setting         // base setting
 	MaxFileSize int // max audio file size allowed
 }
 
 func NewAudioRouter(setting AudioRouterSetting) *mux.Router {
-	auth := middleware.NewTokenAuthenticator()
-	extractor := middleware.NewFileExtractor(setting.MaxFileSize, AudioFileField)
+	auth := setting.authenticator()
+	scope := middleware.NewScopeVerifier(middleware.ScopeAudioUpload)
+	extractor := middleware.NewFileExtractor(setting.MaxFileSize, AudioFileField, AudioFormats...)
+	scan := middleware.NewScanVerifier(setting.Scanner, AudioFileField)
 	r := mux.NewRouter()
-	r.Use(auth.Verify, extractor.Verify)
+	r.Use(tracing.Extract, middleware.NewRequestLogger(processor.KindAudio).Handle)
 
 	opts := processor.AudioProcessorOptions{}
 	p := processor.NewAudioProcessor(setting.Context, opts)
+	setting.register(&p)
+	setting.registerStorageCheck(processor.KindAudio)
+	setting.registerCheck(FFmpegCheck, util.CheckFFmpeg)
+	prioritizer := middleware.NewPrioritizer(setting.TierPriorities, nil)
 
-	r.HandleFunc(setting.Path, func(w http.ResponseWriter, r *http.Request) {
+	upload := r.NewRoute().Subrouter()
+	upload.Use(
+		metrics.Uploads(processor.KindAudio),
+		tracing.Middleware(tracing.MethodName(auth, "Verify"), auth.Verify),
+		scope.Verify,
+		setting.rateLimit,
+		tracing.Middleware(tracing.MethodName(extractor, "Verify"), extractor.Verify),
+		scan.Verify,
+	)
+	upload.HandleFunc(setting.Path, func(w http.ResponseWriter, r *http.Request) {
 		dataPtr := r.Context().Value(AudioFileField).(*[]byte)
+		inputSize := len(*dataPtr)
+		metrics.SetUpload(r.Context(), "", inputSize)
 
-		result, err := p.AddAudio(dataPtr)
+		start := time.Now()
+		result, err := p.AddAudio(prioritizer.Context(r, ""), dataPtr)
 		if err != nil {
-			ServerErrorResponseAndLog(w, "audio add failed", ErrAddToProcessor)
+			AddErrorResponseAndLog(w, r, "audio add failed", err)
 			return
 		}
 		select {
 		case <-time.After(30 * time.Second):
-			ServerErrorResponseAndLog(w, "convert timed out", ErrTimedOut)
+			ErrorResponseAndLog(w, r, util.ErrCodeTransformTimedOut, "convert timed out", ErrTimedOut)
 		case <-result.Done():
-			if result.ConvertError != nil {
-				ServerErrorResponseAndLog(w, "convert failed", result.ConvertError)
+			if result.Error != nil {
+				ErrorResponseAndLog(w, r, util.ErrCodeTransformFailed, "convert failed", result.Error)
 				return
 			}
 			audioBuf := result.Buffer
 			hashString := util.GetMd5String(audioBuf)
 
-			path, err2 := setting.Storage.Save(hashString, "audio/mpeg", audioBuf)
+			path, err2 := setting.storage(r).Save(storagePath(r, hashString), AudioContentType, audioBuf)
 			if err2 != nil {
-				ServerErrorResponseAndLog(w, "audio save failed", result.ConvertError)
+				ErrorResponseAndLog(w, r, util.ErrCodeStorageFailed, "audio save failed", err2)
 				return
 			}
-			util.WriteOkResponse(w, GetResponse(path))
+			metrics.ObserveCompression(processor.KindAudio, inputSize, len(*audioBuf))
+			response := GetResponse(path)
+			response.AssetMetadata = audioMetadata(result)
+			response.setContent(inputSize, audioBuf, hashString, start)
+			util.WriteOkResponse(w, response)
+		}
+	}).Methods(http.MethodPost)
+
+	r.HandleFunc(setting.Path+QueueStatusPath, QueueStatusHandler(&p)).Methods(http.MethodGet)
+
+	if setting.Journal != nil {
+		runner := asyncRunner{
+			Context: setting.Context,
+			Journal: setting.Journal,
+			Kind:    processor.KindAudio,
+			Storage: setting.asyncStorage,
+			Process: func(ctx context.Context, entry *journal.Entry, data []byte) (*[]byte, AssetMetadata, error) {
+				result, err := p.AddAudio(ctx, &data)
+				if err != nil {
+					return nil, AssetMetadata{}, err
+				}
+				<-result.Done()
+				return result.Buffer, audioMetadata(result), result.Error
+			},
 		}
-	})
+		upload.HandleFunc(setting.Path+AsyncPath, func(w http.ResponseWriter, r *http.Request) {
+			buf := r.Context().Value(AudioFileField).(*[]byte)
+			metrics.SetUpload(r.Context(), "", len(*buf))
+			runner.accept(w, r, nil, "", *buf, prioritizer.Scheduling(r, ""), setting.storage(r))
+		}).Methods(http.MethodPost)
+
+		status := r.NewRoute().Subrouter()
+		status.Use(auth.Verify, scope.Verify)
+		status.HandleFunc(setting.Path+AsyncPath+"/{"+AsyncJobVar+"}", runner.status).Methods(http.MethodGet)
+		runner.replay()
+	}
 	return r
 }
@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aperture147/mediaproxy/journal"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/scanner"
 	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tracing"
 	"github.com/aperture147/mediaproxy/util"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
@@ -16,9 +24,69 @@ var (
 	ErrAddToProcessor = errors.New("cannot add to processor")
 )
 
+const (
+	// Seconds a client is asked to wait before retrying when a processor queue is full
+	QueueFullRetryAfter = 5
+
+	// Appended to the router path to get the queue status endpoint
+	QueueStatusPath = "/queue"
+)
+
+// Algorithm of AssetMetadata.Hash, the stored file is named after the hash
+const HashAlgorithmMd5 = "md5"
+
+// What the backend needs to know about a stored asset without fetching it
+type AssetMetadata struct {
+	ContentType   string `json:"content_type,omitempty"`
+	OriginalSize  int    `json:"original_size,omitempty"` // bytes uploaded
+	Size          int    `json:"size,omitempty"`          // bytes stored
+	Hash          string `json:"hash,omitempty"`
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+
+	// Images only
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Preset  string `json:"preset,omitempty"`
+	Quality int    `json:"quality,omitempty"` // encoder quality picked by the target quality search
+
+	// Audio only
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	Bitrate    int   `json:"bitrate,omitempty"` // bits per second
+
+	// From the upload being queued to its result, the queue wait included
+	ProcessingMs int64 `json:"processing_ms,omitempty"`
+}
+
+// Fill in what's known once the result is stored
+func (m *AssetMetadata) setContent(originalSize int, buf *[]byte, hash string, start time.Time) {
+	m.OriginalSize = originalSize
+	m.Size = len(*buf)
+	m.Hash, m.HashAlgorithm = hash, HashAlgorithmMd5
+	m.ProcessingMs = time.Since(start).Milliseconds()
+}
+
+func imageMetadata(result *processor.ImageResult, opts *processor.ImageOptions) AssetMetadata {
+	return AssetMetadata{
+		ContentType: "image/" + opts.ImageType,
+		Width:       result.Width,
+		Height:      result.Height,
+		Quality:     result.Quality,
+	}
+}
+
+func audioMetadata(result *processor.AudioResult) AssetMetadata {
+	return AssetMetadata{
+		ContentType: AudioContentType,
+		DurationMs:  result.Duration.Milliseconds(),
+		Bitrate:     result.Bitrate,
+	}
+}
+
 type PathResponse struct {
 	Path string `json:"path"`
 	Url  string `json:"url"`
+
+	AssetMetadata
 }
 
 func GetResponse(path string) PathResponse {
@@ -28,14 +96,113 @@ func GetResponse(path string) PathResponse {
 	}
 }
 
-func ServerErrorResponseAndLog(w http.ResponseWriter, msg string, err error) {
-	newErr := fmt.Errorf("%s: %v", msg, ErrAddToProcessor)
-	log.Println(newErr)
-	util.WriteServerErrorResponse(w, newErr)
+/*
+Log the error along with what is known about the request, then answer with the
+code of the catalog. The error stays in the logs, the client gets the request id.
+*/
+func ErrorResponseAndLog(w http.ResponseWriter, r *http.Request, code, msg string, err error) {
+	middleware.Logger(r.Context()).Error(msg, err, logging.Fields{"code": code})
+	util.WriteErrorResponse(w, code, nil)
+}
+
+func ServerErrorResponseAndLog(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	ErrorResponseAndLog(w, r, util.ErrCodeInternal, msg, err)
+}
+
+// Write the response of a failed Add call, a full queue or a shutdown are temporary conditions
+func AddErrorResponseAndLog(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if errors.Is(err, processor.ErrQueueFull) || errors.Is(err, processor.ErrShuttingDown) {
+		middleware.Logger(r.Context()).Warn(msg, err, nil)
+	}
+	if errors.Is(err, processor.ErrQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+		util.WriteErrorResponse(w, util.ErrCodeQueueFull, err)
+		return
+	}
+	if errors.Is(err, processor.ErrShuttingDown) {
+		w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+		util.WriteErrorResponse(w, util.ErrCodeShuttingDown, err)
+		return
+	}
+	ServerErrorResponseAndLog(w, r, msg, fmt.Errorf("%v: %w", ErrAddToProcessor, err))
+}
+
+type QueueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// Report the processor queue usage, answers 503 once the queue is full so load balancers can shed load
+func QueueStatusHandler(q processor.QueueStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := QueueStatus{
+			Depth:    q.QueueDepth(),
+			Capacity: q.QueueCapacity(),
+		}
+		if status.Depth >= status.Capacity {
+			w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+			util.WriteJsonResponse(w, http.StatusServiceUnavailable, "queue full", status)
+			return
+		}
+		util.WriteOkResponse(w, status)
+	}
 }
 
 type Setting struct {
 	Context context.Context // father context
 	Storage storage.Storage // storage component
 	Path    string          // router path
+	Scanner scanner.Scanner // optional malware scanner, run before anything is processed or stored
+
+	// Authenticator putting a middleware.Principal in the request context,
+	// nil falls back to the static token authenticator
+	Authenticator middleware.Authenticator
+
+	// Optional per principal rate limit, share it between routers to share the limits
+	RateLimiter *middleware.RateLimiter
+
+	// Optional, the processor of the router is drained when the lifecycle shuts down
+	Lifecycle *Lifecycle
+
+	// Processor priority of each principal tier, nil uses middleware.DefaultTierPriorities
+	TierPriorities map[string]int
+
+	// Durable queue of the async uploads, nil disables them. Share it between routers
+	Journal *journal.Journal
+
+	// Storage of a tenant, used for the async uploads replayed after a restart
+	// since tenant backends only live in memory. nil, or a nil result, picks Storage
+	AsyncStorage func(tenantID string) storage.Storage
+}
+
+func (s Setting) authenticator() middleware.Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	return middleware.NewTokenAuthenticator()
+}
+
+// Middleware verifying the rate limit, or passing through when there is no limiter
+func (s Setting) rateLimit(next http.Handler) http.Handler {
+	if s.RateLimiter == nil {
+		return next
+	}
+	return s.RateLimiter.Verify(next)
+}
+
+// Name of the file in the storage, under the storage prefix of the principal
+func storagePath(r *http.Request, fileName string) string {
+	if p := middleware.PrincipalFromContext(r.Context()); p != nil {
+		return p.StoragePath(fileName)
+	}
+	return fileName
+}
+
+// Storage of the principal (e.g. tenant specific backend), the router one otherwise
+func (s Setting) storage(r *http.Request) storage.Storage {
+	st := s.Storage
+	if p := middleware.PrincipalFromContext(r.Context()); p != nil && p.Storage != nil {
+		st = p.Storage
+	}
+	return tracing.InstrumentStorage(r.Context(), metrics.InstrumentStorage(st))
 }
@@ -0,0 +1,80 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+type fakeQueue struct {
+	depth, capacity int
+}
+
+func (q fakeQueue) QueueDepth() int    { return q.depth }
+func (q fakeQueue) QueueCapacity() int { return q.capacity }
+
+func TestQueueStatusHandler(t *testing.T) {
+	cases := []struct {
+		queue    fakeQueue
+		expected int
+	}{
+		{fakeQueue{0, 10}, http.StatusOK},
+		{fakeQueue{9, 10}, http.StatusOK},
+		{fakeQueue{10, 10}, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		QueueStatusHandler(c.queue)(w, httptest.NewRequest(http.MethodGet, "/queue", nil))
+		if w.Code != c.expected {
+			t.Errorf("queue %d/%d: expected %d, got %d", c.queue.depth, c.queue.capacity, c.expected, w.Code)
+		}
+	}
+}
+
+func TestAddErrorResponseQueueFull(t *testing.T) {
+	w := httptest.NewRecorder()
+	AddErrorResponseAndLog(w, httptest.NewRequest(http.MethodPost, "/upload", nil), "add failed", fmt.Errorf("image: %w", processor.ErrQueueFull))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+}
+
+func TestServerErrorResponseLogsError(t *testing.T) {
+	var buf bytes.Buffer
+	logging.Default.SetOutput(&buf)
+	defer logging.Default.SetOutput(os.Stderr)
+
+	cause := errors.New("bucket unreachable")
+	handler := middleware.NewRequestLogger(processor.KindImage).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServerErrorResponseAndLog(w, r, "save failed", fmt.Errorf("s3: %w", cause))
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["request_id"] != "req-1" || line["router"] != processor.KindImage || line["msg"] != "save failed" {
+		t.Fatalf("unexpected log line %v", line)
+	}
+	if line["error"] != "s3: bucket unreachable" {
+		t.Fatalf("expected the real error, got %v", line["error"])
+	}
+}
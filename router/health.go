@@ -0,0 +1,221 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/util"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Liveness, fails when a processor has wedged workers and the instance must be restarted
+	HealthPath = "/healthz"
+	// Readiness, fails while the instance can't take uploads
+	ReadyPath = "/readyz"
+
+	// Names of the checks in the reports
+	FFmpegCheck        = "ffmpeg"
+	ShutdownCheck      = "shutdown"
+	StorageCheckPrefix = "storage."
+	QueueCheckPrefix   = "queue."
+	WorkersCheckPrefix = "workers."
+
+	// A dependency check taking longer fails
+	DefaultCheckTimeout = 5 * time.Second
+	// The dependency results are reused for this long, so the probes don't write to the storages every few seconds
+	DefaultCheckInterval = 30 * time.Second
+
+	CheckStatusOk   = "ok"
+	CheckStatusFail = "fail"
+)
+
+var (
+	ErrShuttingDown   = errors.New("shutting down")
+	ErrQueueSaturated = errors.New("queue saturated")
+)
+
+type HealthRouterSetting struct {
+	// Processors and dependency checks of the routers, share it with the router settings
+	Lifecycle *Lifecycle
+
+	// Share of a queue capacity in use above which the instance isn't ready, 0 only fails on a full queue
+	MaxQueueUsage float64
+
+	// 0 uses DefaultCheckTimeout and DefaultCheckInterval, a negative interval checks on every probe
+	CheckTimeout  time.Duration
+	CheckInterval time.Duration
+}
+
+// The probes are public, the error of a failed check is only logged
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Last result of a dependency check
+type cachedCheck struct {
+	err     error
+	checked time.Time
+}
+
+// Runs the dependency checks, at most once per interval
+type checkRunner struct {
+	mutex    sync.Mutex
+	timeout  time.Duration
+	interval time.Duration
+	results  map[string]cachedCheck
+}
+
+// Run check with a timeout, a storage call can't be cancelled so it's left behind
+func (c *checkRunner) run(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Result of every check, running in parallel the ones not checked for an interval
+func (c *checkRunner) runAll(ctx context.Context, checks map[string]Check) map[string]error {
+	now := time.Now()
+	errs := make(map[string]error, len(checks))
+	var stale []string
+	c.mutex.Lock()
+	for name := range checks {
+		if cached, ok := c.results[name]; ok && now.Sub(cached.checked) < c.interval {
+			errs[name] = cached.err
+		} else {
+			stale = append(stale, name)
+		}
+	}
+	c.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	fresh := make([]error, len(stale))
+	for i, name := range stale {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			fresh[i] = c.run(ctx, check)
+		}(i, checks[name])
+	}
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, name := range stale {
+		c.results[name] = cachedCheck{err: fresh[i], checked: now}
+		errs[name] = fresh[i]
+	}
+	return errs
+}
+
+// Name of a processor in the check names
+func processorName(p Shutdowner) string {
+	if s, ok := p.(processor.Scaler); ok {
+		return s.WorkerStatus().Name
+	}
+	return "unknown"
+}
+
+// Answer 200 when every check passed, 503 otherwise. The failures are logged
+func writeHealthReport(w http.ResponseWriter, errs map[string]error) {
+	report := HealthReport{Status: CheckStatusOk, Checks: make([]CheckResult, 0, len(errs))}
+	for name, err := range errs {
+		result := CheckResult{Name: name, Status: CheckStatusOk}
+		if err != nil {
+			result.Status = CheckStatusFail
+			report.Status = CheckStatusFail
+			logging.Warn("health check failed", err, logging.Fields{"check": name})
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+
+	if report.Status != CheckStatusOk {
+		util.WriteJsonResponse(w, http.StatusServiceUnavailable, "unhealthy", report)
+		return
+	}
+	util.WriteOkResponse(w, report)
+}
+
+/*
+Kubernetes probes, without authentication:
+GET /healthz fails when a worker is wedged, restarting is the only way out.
+GET /readyz fails while shutting down, when ffmpeg or a storage doesn't work or when a queue is saturated.
+*/
+func NewHealthRouter(setting HealthRouterSetting) *mux.Router {
+	lifecycle := setting.Lifecycle
+	if lifecycle == nil {
+		lifecycle = NewLifecycle()
+	}
+	runner := &checkRunner{
+		timeout:  setting.CheckTimeout,
+		interval: setting.CheckInterval,
+		results:  make(map[string]cachedCheck),
+	}
+	if runner.timeout == 0 {
+		runner.timeout = DefaultCheckTimeout
+	}
+	if runner.interval == 0 {
+		runner.interval = DefaultCheckInterval
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc(HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		errs := make(map[string]error)
+		for _, p := range lifecycle.Processors() {
+			if h, ok := p.(processor.HealthChecker); ok {
+				errs[WorkersCheckPrefix+processorName(p)] = h.CheckHealth()
+			}
+		}
+		writeHealthReport(w, errs)
+	}).Methods(http.MethodGet)
+
+	r.HandleFunc(ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		if lifecycle.ShuttingDown() {
+			// don't bother checking, the instance is going away
+			writeHealthReport(w, map[string]error{ShutdownCheck: ErrShuttingDown})
+			return
+		}
+		errs := runner.runAll(r.Context(), lifecycle.Checks())
+		for _, p := range lifecycle.Processors() {
+			if q, ok := p.(processor.QueueStats); ok {
+				errs[QueueCheckPrefix+processorName(p)] = queueCheck(q, setting.MaxQueueUsage)
+			}
+		}
+		writeHealthReport(w, errs)
+	}).Methods(http.MethodGet)
+	return r
+}
+
+func queueCheck(q processor.QueueStats, maxUsage float64) error {
+	depth, capacity := q.QueueDepth(), q.QueueCapacity()
+	saturated := depth >= capacity
+	if maxUsage > 0 && maxUsage < 1 {
+		saturated = float64(depth) >= maxUsage*float64(capacity)
+	}
+	if saturated {
+		return fmt.Errorf("%w: %d/%d jobs", ErrQueueSaturated, depth, capacity)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/processor"
+	"github.com/aperture147/mediaproxy/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func healthRequest(t *testing.T, h http.Handler, path string) (int, HealthReport) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var response struct {
+		Data HealthReport `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, response.Data
+}
+
+func failedChecks(report HealthReport) []string {
+	var failed []string
+	for _, check := range report.Checks {
+		if check.Status != CheckStatusOk {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestHealthRouterReadiness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := processor.NewSvgProcessor(nil, processor.SvgProcessorOptions{Routines: 1})
+	p.Start()
+	defer p.Cancel()
+	lifecycle := NewLifecycle()
+	lifecycle.Register(&p)
+	Setting{Storage: storage.NewFileSystemStorage(dir), Lifecycle: lifecycle}.registerStorageCheck(processor.KindSvg)
+
+	healthy := true
+	lifecycle.RegisterCheck("dependency", func(ctx context.Context) error {
+		if healthy {
+			return nil
+		}
+		return errors.New("dependency down")
+	})
+	health := NewHealthRouter(HealthRouterSetting{Lifecycle: lifecycle, CheckInterval: -1})
+
+	code, report := healthRequest(t, health, ReadyPath)
+	if code != http.StatusOK || len(report.Checks) != 3 {
+		t.Fatalf("expected ready, got %d %+v", code, report)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("probe file left behind: %v", files[0].Name())
+	}
+
+	healthy = false
+	code, report = healthRequest(t, health, ReadyPath)
+	if failed := failedChecks(report); code != http.StatusServiceUnavailable || len(failed) != 1 || failed[0] != "dependency" {
+		t.Fatalf("expected the dependency to fail, got %d %+v", code, report)
+	}
+	w := httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ReadyPath, nil))
+	if strings.Contains(w.Body.String(), "dependency down") {
+		t.Fatalf("check error leaked: %s", w.Body.String())
+	}
+
+	healthy = true
+	lifecycle.Shutdown(context.Background(), nil)
+	if code, report = healthRequest(t, health, ReadyPath); code != http.StatusServiceUnavailable || report.Checks[0].Name != ShutdownCheck {
+		t.Fatalf("expected not ready while shutting down, got %d %+v", code, report)
+	}
+	// shutting down is not a reason to be restarted
+	if code, _ = healthRequest(t, health, HealthPath); code != http.StatusOK {
+		t.Fatalf("expected alive while shutting down, got %d", code)
+	}
+}
+
+func TestQueueCheck(t *testing.T) {
+	cases := []struct {
+		queue     fakeQueue
+		maxUsage  float64
+		saturated bool
+	}{
+		{fakeQueue{9, 10}, 0, false},
+		{fakeQueue{10, 10}, 0, true},
+		{fakeQueue{7, 10}, 0.8, false},
+		{fakeQueue{8, 10}, 0.8, true},
+	}
+	for _, c := range cases {
+		err := queueCheck(c.queue, c.maxUsage)
+		if errors.Is(err, ErrQueueSaturated) != c.saturated {
+			t.Errorf("queue %d/%d at %v: expected saturated %v, got %v", c.queue.depth, c.queue.capacity, c.maxUsage, c.saturated, err)
+		}
+	}
+}
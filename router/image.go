@@ -1,12 +1,21 @@
 package router
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/journal"
+	"github.com/aperture147/mediaproxy/metrics"
 	"github.com/aperture147/mediaproxy/processor"
 	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tracing"
 	"github.com/aperture147/mediaproxy/util"
 	"github.com/discord/lilliput"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -14,12 +23,49 @@ const (
 	ImageFileField  = "imageFile"
 	ImageOptionsKey = "options"
 	ImageDataKey    = "data"
+	ImageNameVar    = "name"
 )
 
+// Formats accepted by the image upload
+var ImageFormats = []string{util.FormatJpeg, util.FormatPng, util.FormatWebp, util.FormatGif}
+
+var (
+	ErrUnknownImageType   = errors.New("unknown image type")
+	errVariantRateLimited = errors.New("variant rate limited")
+)
+
+// Variants a client may have generated by the serve route, the cached ones are always served
+var DefaultVariantRateLimit = middleware.RateLimit{Rate: 0.2, Burst: 5}
+
 type ImageRouterSetting struct {
 	Setting
 	MaxFileSize     int
 	MaxImageDimSize int
+
+	// Pixel count, frame count and memory limits checked before queuing
+	middleware.ImageLimits
+
+	// Target SSIM score for lossy formats, 0 keeps the static encoder quality
+	TargetQuality float64
+
+	// Path serving the stored images back, must end with the {name} variable,
+	// e.g. /image/{name}, which matches the rest of the path so prefixed files
+	// like tenants/acme/{hash} are served too. Only the router Storage is served,
+	// the route is public so the tenant and async storages can't be picked.
+	// Leave it empty to disable serving
+	ServePath string
+
+	// Generated variants per client ip on the serve route, zero uses DefaultVariantRateLimit.
+	// Past the limit a missing variant isn't generated and the original is served.
+	// Variants are generated with the lowest priority
+	VariantRateLimit middleware.RateLimit
+
+	// Overlay stamped onto the images uploaded with one of the WatermarkPresets
+	Watermark        *processor.Watermark
+	WatermarkPresets []string
+
+	// Processor priority of the presets, nil uses middleware.DefaultPresetPriorities
+	PresetPriorities map[string]int
 }
 
 /*
@@ -29,45 +75,234 @@ maxImageSize: max width and height of the image
 storage: storage component, with API helps storing image
 */
 func NewImageRouter(setting ImageRouterSetting) *mux.Router {
-	auth := middleware.NewTokenAuthenticator()
-	extractor := middleware.NewFileExtractor(setting.MaxFileSize, ImageFileField)
-	decoder := middleware.NewImageDecoder(setting.MaxImageDimSize, ImageFileField, ImageOptionsKey, ImageDataKey)
+	auth := setting.authenticator()
+	scope := middleware.NewScopeVerifier(middleware.ScopeImageUpload)
+	extractor := middleware.NewFileExtractor(setting.MaxFileSize, ImageFileField, ImageFormats...)
+	scan := middleware.NewScanVerifier(setting.Scanner, ImageFileField)
+	decoder := middleware.NewImageDecoder(setting.MaxImageDimSize, setting.ImageLimits, ImageFileField, ImageOptionsKey, ImageDataKey, setting.WatermarkPresets...)
 
 	r := mux.NewRouter()
-	r.Use(auth.Verify, extractor.Verify, decoder.Decode)
+	r.Use(tracing.Extract, middleware.NewRequestLogger(processor.KindImage).Handle)
 
 	opts := processor.ImageProcessorOptions{
-		MaxImageSize: setting.MaxImageDimSize,
+		MaxImageSize:  setting.MaxImageDimSize,
+		TargetQuality: setting.TargetQuality,
+		Watermark:     setting.Watermark,
 	}
 	p := processor.NewImageProcessor(setting.Context, opts)
+	setting.register(&p)
+	setting.registerStorageCheck(processor.KindImage)
+	prioritizer := middleware.NewPrioritizer(setting.TierPriorities, setting.PresetPriorities)
 
-	r.HandleFunc(setting.Path, func(w http.ResponseWriter, r *http.Request) {
+	upload := r.NewRoute().Subrouter()
+	upload.Use(
+		metrics.Uploads(processor.KindImage),
+		tracing.Middleware(tracing.MethodName(auth, "Verify"), auth.Verify),
+		scope.Verify,
+		setting.rateLimit,
+		tracing.Middleware(tracing.MethodName(extractor, "Verify"), extractor.Verify),
+		scan.Verify,
+		tracing.Middleware(tracing.MethodName(decoder, "Decode"), decoder.Decode),
+	)
+	upload.HandleFunc(setting.Path, func(w http.ResponseWriter, r *http.Request) {
 		optsPtr := r.Context().Value(ImageOptionsKey).(*processor.ImageOptions)
-		dataPtr := r.Context().Value(ImageDataKey).(*lilliput.Decoder)
+		// the processor decodes the file again, it may need to retry with a larger buffer
+		(*r.Context().Value(ImageDataKey).(*lilliput.Decoder)).Close()
+		buf := r.Context().Value(ImageFileField).(*[]byte)
 
-		result, err := p.AddImage(dataPtr, optsPtr)
+		preset := middleware.ImagePreset(r.FormValue(middleware.ImageQualityField))
+		metrics.SetUpload(r.Context(), preset, len(*buf))
+		start := time.Now()
+		result, err := p.AddImageBuffer(prioritizer.Context(r, preset), *buf, optsPtr)
 		if err != nil {
-			ServerErrorResponseAndLog(w, "image add failed", ErrAddToProcessor)
+			AddErrorResponseAndLog(w, r, "image add failed", err)
 			return
 		}
 		select {
 		case <-time.After(30 * time.Second):
-			ServerErrorResponseAndLog(w, "transform timed out", ErrTimedOut)
+			ErrorResponseAndLog(w, r, util.ErrCodeTransformTimedOut, "transform timed out", ErrTimedOut)
 		case <-result.Done():
-			if result.TransformationError != nil {
-				ServerErrorResponseAndLog(w, "transformation failed", result.TransformationError)
+			if result.Error != nil {
+				ErrorResponseAndLog(w, r, util.ErrCodeTransformFailed, "transformation failed", result.Error)
 				return
 			}
 			imgBuf := result.Buffer
 			hashString := util.GetMd5String(imgBuf)
-			path, err2 := setting.Storage.Save(hashString, "image/"+optsPtr.ImageType, imgBuf)
+			metadata := imageMetadata(result, optsPtr)
+			path, err2 := setting.storage(r).Save(storagePath(r, hashString), metadata.ContentType, imgBuf)
 			if err2 != nil {
-				ServerErrorResponseAndLog(w, "image save failed", err2)
+				ErrorResponseAndLog(w, r, util.ErrCodeStorageFailed, "image save failed", err2)
 				return
 			}
-			util.WriteOkResponse(w, GetResponse(path))
+			metrics.ObserveCompression(processor.KindImage, len(*buf), len(*imgBuf))
+			response := GetResponse(path)
+			response.AssetMetadata = metadata
+			response.Preset = preset
+			response.setContent(len(*buf), imgBuf, hashString, start)
+			util.WriteOkResponse(w, response)
+		}
+	}).Methods(http.MethodPost)
+
+	r.HandleFunc(setting.Path+QueueStatusPath, QueueStatusHandler(&p)).Methods(http.MethodGet)
+
+	if setting.Journal != nil {
+		runner := asyncRunner{
+			Context: setting.Context,
+			Journal: setting.Journal,
+			Kind:    processor.KindImage,
+			Storage: setting.asyncStorage,
+			Process: func(ctx context.Context, entry *journal.Entry, data []byte) (*[]byte, AssetMetadata, error) {
+				var opts processor.ImageOptions
+				if err := json.Unmarshal(entry.Options, &opts); err != nil {
+					return nil, AssetMetadata{}, err
+				}
+				result, err := p.AddImageBuffer(ctx, data, &opts)
+				if err != nil {
+					return nil, AssetMetadata{}, err
+				}
+				<-result.Done()
+				return result.Buffer, imageMetadata(result, &opts), result.Error
+			},
 		}
-	})
+		upload.HandleFunc(setting.Path+AsyncPath, func(w http.ResponseWriter, r *http.Request) {
+			optsPtr := r.Context().Value(ImageOptionsKey).(*processor.ImageOptions)
+			// the job decodes the journaled input again, it may be replayed by another process
+			(*r.Context().Value(ImageDataKey).(*lilliput.Decoder)).Close()
+			buf := r.Context().Value(ImageFileField).(*[]byte)
+
+			preset := middleware.ImagePreset(r.FormValue(middleware.ImageQualityField))
+			metrics.SetUpload(r.Context(), preset, len(*buf))
+			runner.accept(w, r, optsPtr, preset, *buf, prioritizer.Scheduling(r, preset), setting.storage(r))
+		}).Methods(http.MethodPost)
+
+		status := r.NewRoute().Subrouter()
+		status.Use(auth.Verify, scope.Verify)
+		status.HandleFunc(setting.Path+AsyncPath+"/{"+AsyncJobVar+"}", runner.status).Methods(http.MethodGet)
+		runner.replay()
+	}
+
+	if setting.ServePath != "" {
+		st := metrics.InstrumentStorage(setting.Storage)
+		variantLimit := setting.VariantRateLimit
+		if variantLimit == (middleware.RateLimit{}) {
+			variantLimit = DefaultVariantRateLimit
+		}
+		variantLimiter := middleware.NewRateLimiter(variantLimit, nil)
+		servePath := strings.Replace(setting.ServePath, "{"+ImageNameVar+"}", "{"+ImageNameVar+":.+}", 1)
+		r.HandleFunc(servePath, func(w http.ResponseWriter, r *http.Request) {
+			name := mux.Vars(r)[ImageNameVar]
+			if !validImageName(name) {
+				http.NotFound(w, r)
+				return
+			}
+			st := tracing.InstrumentStorage(r.Context(), st)
+			original, err := st.Load(name)
+			if errors.Is(err, storage.ErrNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				ErrorResponseAndLog(w, r, util.ErrCodeStorageFailed, "image load failed", err)
+				return
+			}
+
+			contentType := http.DetectContentType(*original)
+			originalType, ok := mimeImageTypes[contentType]
+			if !ok {
+				ServerErrorResponseAndLog(w, r, "image load failed", ErrUnknownImageType)
+				return
+			}
+
+			imageType := NegotiateImageType(r.Header.Get("Accept"), originalType)
+			buf := original
+			if imageType != originalType {
+				// the route is public, anonymous clients only get background work done within their limit
+				client := "ip:" + clientIP(r)
+				mayGenerate := func() bool {
+					release, _, err := variantLimiter.Acquire(client, middleware.TierDefault)
+					if err != nil {
+						return false
+					}
+					release()
+					return true
+				}
+				ctx := processor.WithScheduling(r.Context(), processor.Scheduling{Priority: processor.PriorityLow, Key: client})
+				buf, err = loadImageVariant(ctx, st, &p, name, original, imageType, mayGenerate)
+				if errors.Is(err, errVariantRateLimited) {
+					buf, imageType, err = original, originalType, nil
+				}
+				if errors.Is(err, processor.ErrQueueFull) {
+					AddErrorResponseAndLog(w, r, "image variant failed", err)
+					return
+				}
+				if err != nil {
+					ServerErrorResponseAndLog(w, r, "image variant failed", err)
+					return
+				}
+			}
+
+			w.Header().Set("Content-Type", "image/"+imageType)
+			w.Header().Set("Vary", "Accept")
+			w.WriteHeader(http.StatusOK)
+			w.Write(*buf)
+		}).Methods(http.MethodGet)
+	}
 
 	return r
 }
+
+// A served name stays inside the storage, it can't hold a ".." segment nor start with "/"
+func validImageName(name string) bool {
+	if strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Address of the client, a proxy in front of the router is seen as a single client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+Variants are stored next to the original as {name}.{imageType}.
+A missing variant is generated from the original without resizing it, when mayGenerate allows it,
+then persisted so the next request for the same variant is a cache hit.
+*/
+func loadImageVariant(ctx context.Context, s storage.Storage, p *processor.ImageProcessor, name string, original *[]byte, imageType string, mayGenerate func() bool) (*[]byte, error) {
+	variantName := name + "." + imageType
+	variant, err := s.Load(variantName)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return variant, err
+	}
+	if !mayGenerate() {
+		return nil, errVariantRateLimited
+	}
+
+	result, err := p.AddImageBuffer(ctx, *original, &processor.ImageOptions{ImageType: imageType})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(30 * time.Second):
+		return nil, ErrTimedOut
+	case <-result.Done():
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	if _, err = s.Save(variantName, "image/"+imageType, result.Buffer); err != nil {
+		return nil, err
+	}
+	return result.Buffer, nil
+}
@@ -1,10 +1,20 @@
 package router
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"github.com/aperture147/mediaproxy/router/middleware"
 	"github.com/aperture147/mediaproxy/storage"
+	"image"
+	"image/png"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -20,3 +30,213 @@ func TestNewImageRouter(t *testing.T) {
 	}
 	log.Fatalln(http.ListenAndServe(":8080", NewImageRouter(setting)))
 }
+
+func TestImageRouterServeVariant(t *testing.T) {
+	dir := t.TempDir()
+	s := storage.NewFileSystemStorage(dir)
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+	if _, err := s.Save("original", "image/png", &original); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: s,
+			Path:    "/image/upload",
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+		ServePath:       "/image/{name}",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/image/original", nil)
+	req.Header.Set("Accept", "image/webp,*/*")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "image/webp" || w.Header().Get("Vary") != "Accept" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+	if _, err := s.Load("original.webp"); err != nil {
+		t.Fatalf("variant not persisted: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/image/original", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), original) {
+		t.Fatal("expected the original png")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/image/missing", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+
+	// prefixed files are served too
+	if _, err := s.Save("tenants/acme/original", "image/png", &original); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/image/tenants/acme/original", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), original) {
+		t.Fatalf("expected the prefixed original, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/image/tenants/../../original", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Fatal("a path escaping the storage was served")
+	}
+	for name, valid := range map[string]bool{"a/b": true, "a/../b": false, "..": false, "/etc/passwd": false, "a..b": true} {
+		if validImageName(name) != valid {
+			t.Errorf("expected %s to be valid: %v", name, valid)
+		}
+	}
+}
+
+func TestImageRouterServeVariantRateLimit(t *testing.T) {
+	s := storage.NewFileSystemStorage(t.TempDir())
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+	for _, name := range []string{"first", "second"} {
+		if _, err := s.Save(name, "image/png", &original); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: s,
+			Path:    "/image/upload",
+		},
+		MaxFileSize:      10,
+		MaxImageDimSize:  1024,
+		ServePath:        "/image/{name}",
+		VariantRateLimit: middleware.RateLimit{Rate: 0.001, Burst: 1},
+	})
+	serve := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/image/"+name, nil)
+		req.Header.Set("Accept", "image/webp,*/*")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("first"); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("expected a generated webp, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// the limit is spent, the original is served and nothing is generated
+	w := serve("second")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), original) {
+		t.Fatalf("expected the original png, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, err := s.Load("second.webp"); err == nil {
+		t.Fatal("a variant was generated past the limit")
+	}
+
+	// cached variants don't count against the limit
+	if w := serve("first"); w.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("expected the cached webp, got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestImageRouterResponseMetadata(t *testing.T) {
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: storage.NewFileSystemStorage(t.TempDir()),
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject: "tester",
+				Scopes:  []string{middleware.ScopeImageUpload},
+			}},
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	})
+	original := testPng(t)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartUpload(t, "/image/upload", ImageFileField, "test.png", "image/png", original))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Data PathResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	metadata := response.Data.AssetMetadata
+	if !strings.HasPrefix(metadata.ContentType, "image/") || metadata.Preset != middleware.ImageQualityDefault {
+		t.Errorf("unexpected content type %q and preset %q", metadata.ContentType, metadata.Preset)
+	}
+	if metadata.OriginalSize != len(original) || metadata.Size == 0 {
+		t.Errorf("unexpected sizes %d -> %d", metadata.OriginalSize, metadata.Size)
+	}
+	if metadata.HashAlgorithm != HashAlgorithmMd5 || !strings.HasSuffix(response.Data.Path, metadata.Hash) {
+		t.Errorf("hash %s %q doesn't name %s", metadata.HashAlgorithm, metadata.Hash, response.Data.Path)
+	}
+	if metadata.Width == 0 || metadata.Height == 0 || metadata.Width > 64 || metadata.Height > 64 {
+		t.Errorf("unexpected dimensions %dx%d", metadata.Width, metadata.Height)
+	}
+}
+
+func TestImageRouterStoragePrefix(t *testing.T) {
+	dir := t.TempDir()
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: storage.NewFileSystemStorage(dir),
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject:       "tester",
+				Scopes:        []string{middleware.ScopeImageUpload},
+				StoragePrefix: "users/tester",
+			}},
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartUpload(t, "/image/upload", ImageFileField, "test.png", "image/png", testPng(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Data PathResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	fileName := path.Join("users/tester", response.Data.Hash)
+	if !strings.HasSuffix(response.Data.Path, fileName) {
+		t.Fatalf("path %s isn't under the prefix", response.Data.Path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName)); err != nil {
+		t.Fatal(err)
+	}
+}
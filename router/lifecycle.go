@@ -0,0 +1,140 @@
+package router
+
+import (
+	"context"
+	"github.com/aperture147/mediaproxy/logging"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tracing"
+	"net/http"
+	"sync"
+)
+
+// Implemented by every processor
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Readiness check of a dependency of a router, e.g. its storage
+type Check func(ctx context.Context) error
+
+/*
+Keep track of the processors created by the routers, so a deploy can drain
+them once the http server stopped accepting requests, and of the dependencies
+of the routers checked by the readiness probe.
+Share one Lifecycle between the router settings.
+*/
+type Lifecycle struct {
+	mutex        sync.Mutex
+	processors   []Shutdowner
+	checks       map[string]Check
+	shuttingDown bool
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{checks: make(map[string]Check)}
+}
+
+func (l *Lifecycle) Register(s Shutdowner) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.processors = append(l.processors, s)
+}
+
+// Processors registered so far
+func (l *Lifecycle) Processors() []Shutdowner {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]Shutdowner(nil), l.processors...)
+}
+
+// Register a dependency check, a check registered under the same name is replaced
+func (l *Lifecycle) RegisterCheck(name string, check Check) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.checks == nil {
+		l.checks = make(map[string]Check)
+	}
+	l.checks[name] = check
+}
+
+// Checks registered so far, by name
+func (l *Lifecycle) Checks() map[string]Check {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	checks := make(map[string]Check, len(l.checks))
+	for name, check := range l.checks {
+		checks[name] = check
+	}
+	return checks
+}
+
+// True once Shutdown was called, the instance shouldn't get new requests
+func (l *Lifecycle) ShuttingDown() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.shuttingDown
+}
+
+/*
+Stop the server first, which waits for the in-flight uploads to get their result,
+then drain the processors. The first error is returned, every processor is
+drained anyway. server may be nil when it's shut down elsewhere.
+*/
+func (l *Lifecycle) Shutdown(ctx context.Context, server *http.Server) error {
+	l.mutex.Lock()
+	l.shuttingDown = true
+	l.mutex.Unlock()
+
+	var firstErr error
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			logging.Error("server shutdown failed", err, nil)
+			firstErr = err
+		}
+	}
+
+	processors := l.Processors()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(processors))
+	for i, p := range processors {
+		wg.Add(1)
+		go func(i int, p Shutdowner) {
+			defer wg.Done()
+			errs[i] = p.Shutdown(ctx)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Register the processor of a router, nothing to do without a lifecycle
+func (s Setting) register(p Shutdowner) {
+	if s.Lifecycle != nil {
+		s.Lifecycle.Register(p)
+	}
+}
+
+// Register a readiness check of the router, nothing to do without a lifecycle
+func (s Setting) registerCheck(name string, check Check) {
+	if s.Lifecycle != nil {
+		s.Lifecycle.RegisterCheck(name, check)
+	}
+}
+
+// Readiness check writing then deleting a probe file through the storage of the router
+func (s Setting) registerStorageCheck(kind string) {
+	if s.Storage == nil {
+		return
+	}
+	st := metrics.InstrumentStorage(s.Storage)
+	s.registerCheck(StorageCheckPrefix+kind, func(ctx context.Context) error {
+		return storage.Probe(tracing.InstrumentStorage(ctx, st))
+	})
+}
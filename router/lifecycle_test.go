@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeShutdowner struct {
+	called bool
+	err    error
+}
+
+func (s *fakeShutdowner) Shutdown(ctx context.Context) error {
+	s.called = true
+	return s.err
+}
+
+func TestLifecycleShutdown(t *testing.T) {
+	failing := &fakeShutdowner{err: errors.New("drain failed")}
+	ok := &fakeShutdowner{}
+
+	l := NewLifecycle()
+	l.Register(failing)
+	l.Register(ok)
+	if err := l.Shutdown(context.Background(), nil); err != failing.err {
+		t.Fatalf("expected the processor error, got %v", err)
+	}
+	if !failing.called || !ok.called {
+		t.Fatal("every processor should be drained")
+	}
+}
+
+// Storage holding every save until released, so an upload stays in flight
+type blockingStorage struct {
+	storage.Storage
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Save(fileName, contentType string, buf *[]byte) (string, error) {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.Storage.Save(fileName, contentType, buf)
+}
+
+func TestLifecycleShutdownServer(t *testing.T) {
+	st := &blockingStorage{
+		Storage: storage.NewFileSystemStorage(t.TempDir()),
+		saving:  make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	lifecycle := NewLifecycle()
+	server := httptest.NewUnstartedServer(NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: st,
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject: "tester",
+				Scopes:  []string{middleware.ScopeImageUpload},
+			}},
+			Lifecycle: lifecycle,
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	}))
+	server.Start()
+	defer server.Close()
+
+	upload := func() (*http.Response, error) {
+		r := multipartUpload(t, "/image/upload", ImageFileField, "test.png", "image/png", testPng(t))
+		req, err := http.NewRequest(http.MethodPost, server.URL+r.URL.Path, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = r.Header
+		return server.Client().Do(req)
+	}
+
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		res, err := upload()
+		if err != nil {
+			t.Error(err)
+		}
+		inFlight <- res
+	}()
+	select {
+	case <-st.saving:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upload never reached the storage")
+	}
+
+	// the listener stays open, as when a load balancer stops sending traffic on its own
+	if err := lifecycle.Shutdown(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !lifecycle.ShuttingDown() {
+		t.Fatal("expected the lifecycle to be shutting down")
+	}
+
+	res, err := upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response util.Response
+	json.NewDecoder(res.Body).Decode(&response)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || response.Code != util.ErrCodeShuttingDown {
+		t.Fatalf("expected 503 %s, got %d %s", util.ErrCodeShuttingDown, res.StatusCode, response.Code)
+	}
+
+	close(st.release)
+	select {
+	case res := <-inFlight:
+		if res == nil {
+			t.FailNow()
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected the in-flight upload to finish, got %d", res.StatusCode)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the in-flight upload never finished")
+	}
+}
@@ -0,0 +1,31 @@
+package router
+
+import (
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+const MetricsPath = "/metrics"
+
+type MetricsRouterSetting struct {
+	Path string // router path, MetricsPath when empty
+
+	// Optional, scrapers usually reach the endpoint on a private network
+	Authenticator middleware.Authenticator
+}
+
+// Prometheus endpoint exposing the metrics of every router and processor
+func NewMetricsRouter(setting MetricsRouterSetting) *mux.Router {
+	path := setting.Path
+	if path == "" {
+		path = MetricsPath
+	}
+	r := mux.NewRouter()
+	if setting.Authenticator != nil {
+		r.Use(setting.Authenticator.Verify)
+	}
+	r.Handle(path, metrics.Handler()).Methods(http.MethodGet)
+	return r
+}
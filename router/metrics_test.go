@@ -0,0 +1,73 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func multipartUpload(t *testing.T, path, field, fileName, contentType string, data []byte) *http.Request {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="` + field + `"; filename="` + fileName + `"`},
+		"Content-Type":        {contentType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestMetricsRouter(t *testing.T) {
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: storage.NewFileSystemStorage(t.TempDir()),
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject: "tester",
+				Scopes:  []string{middleware.ScopeImageUpload},
+			}},
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartUpload(t, "/image/upload", ImageFileField, "test.png", "image/png", testPng(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	NewMetricsRouter(MetricsRouterSetting{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, metric := range []string{
+		`mediaproxy_uploads_total{preset="default",router="image",status="200"}`,
+		`mediaproxy_upload_size_bytes_count{preset="default",router="image",status="200"}`,
+		`mediaproxy_queue_depth{processor="image"}`,
+		`mediaproxy_queue_wait_seconds_count{processor="image"}`,
+		`mediaproxy_image_transform_duration_seconds_count{status="ok",type="jpeg"}`,
+		`mediaproxy_storage_save_duration_seconds_count{backend="fs",status="ok"}`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("missing %s", metric)
+		}
+	}
+}
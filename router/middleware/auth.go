@@ -1,7 +1,6 @@
 package middleware
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/aperture147/mediaproxy/util"
@@ -10,8 +9,6 @@ import (
 	"strings"
 )
 
-const SpecialRequestKey = "special"
-
 var (
 	ErrWrongToken = errors.New("wrong token")
 	ErrNoToken    = errors.New("no token provided")
@@ -52,10 +49,12 @@ func (t TokenAuthenticator) Verify(next http.Handler) http.Handler {
 		rawAuth := strings.Split(r.Header.Get("Authorization"), " ")
 		if len(rawAuth) == 2 && rawAuth[0] == "Bearer" {
 			if rawAuth[1] == t.SpecialToken {
-				next.ServeHTTP(w, r.WithContext(context.WithValue(context.Background(), SpecialRequestKey, true)))
+				principal := &Principal{Subject: "special", Scopes: []string{ScopeImageUpload, ScopeAudioUpload, ScopeSpecial}, Tier: TierSpecial}
+				next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
 				return
 			} else if rawAuth[1] == t.Token {
-				next.ServeHTTP(w, r)
+				principal := &Principal{Subject: "token", Scopes: []string{ScopeImageUpload, ScopeAudioUpload}, Tier: TierDefault}
+				next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
 				return
 			}
 		}
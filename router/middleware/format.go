@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/util"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+)
+
+var (
+	ErrUnknownFormat       = errors.New("unknown file format")
+	ErrFormatNotAllowed    = errors.New("file format not allowed")
+	ErrContentTypeMismatch = errors.New("declared content type doesn't match the file content")
+	ErrExtensionMismatch   = errors.New("file extension doesn't match the file content")
+	ErrPolyglotFile        = errors.New("file is valid as more than one format")
+)
+
+// Content types which don't declare anything, clients send them when they don't know better
+var undeclaredContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+}
+
+/*
+Sniff the magic bytes of the uploaded file then make sure that the format is allowed,
+that it agrees with what the client declared (multipart content type and file name extension)
+and that the file doesn't smuggle another format along.
+*/
+func ValidateFormat(buf []byte, header *multipart.FileHeader, allowed []string) (string, error) {
+	format := util.SniffFormat(buf)
+	if format == "" {
+		return "", ErrUnknownFormat
+	}
+
+	isAllowed := false
+	for _, f := range allowed {
+		if f == format {
+			isAllowed = true
+			break
+		}
+	}
+	if !isAllowed {
+		return "", fmt.Errorf("%w: %s", ErrFormatNotAllowed, format)
+	}
+
+	contentType := header.Header.Get("Content-Type")
+	if !undeclaredContentTypes[contentType] && !util.MatchesMimeType(format, contentType) {
+		return "", fmt.Errorf("%w: %s is not %s", ErrContentTypeMismatch, contentType, format)
+	}
+
+	if filepath.Ext(header.Filename) != "" && !util.MatchesExtension(format, header.Filename) {
+		return "", fmt.Errorf("%w: %s is not %s", ErrExtensionMismatch, header.Filename, format)
+	}
+
+	if util.IsPolyglot(buf) {
+		return "", ErrPolyglotFile
+	}
+	return format, nil
+}
+
+func WriteUnsupportedFormatResponse(w http.ResponseWriter, err error) {
+	util.WriteErrorResponse(w, util.ErrCodeUnsupportedFormat, err)
+}
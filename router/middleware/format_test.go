@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/aperture147/mediaproxy/util"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+)
+
+func fileHeader(fileName, contentType string) *multipart.FileHeader {
+	return &multipart.FileHeader{
+		Filename: fileName,
+		Header:   textproto.MIMEHeader{"Content-Type": []string{contentType}},
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 0x10, 'J', 'F', 'I', 'F', 0}
+	gifar := append([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), []byte("PK\x05\x06\x00\x00\x00\x00")...)
+	html := append(append([]byte{}, jpeg...), []byte("<script>alert(1)</script>")...)
+	mp3 := []byte("ID3\x04\x00\x00\x00\x00\x00\x00")
+	images := []string{util.FormatJpeg, util.FormatPng, util.FormatWebp, util.FormatGif}
+
+	cases := []struct {
+		name   string
+		buf    []byte
+		header *multipart.FileHeader
+		err    error
+	}{
+		{"jpeg", jpeg, fileHeader("photo.JPG", "image/jpeg"), nil},
+		{"undeclared", jpeg, fileHeader("blob", "application/octet-stream"), nil},
+		{"unknown", []byte("hello world"), fileHeader("a.txt", "text/plain"), ErrUnknownFormat},
+		{"not allowed", mp3, fileHeader("a.mp3", "audio/mpeg"), ErrFormatNotAllowed},
+		{"content type", jpeg, fileHeader("a.jpg", "image/png"), ErrContentTypeMismatch},
+		{"extension", jpeg, fileHeader("a.png", "image/jpeg"), ErrExtensionMismatch},
+		{"gifar", gifar, fileHeader("a.gif", "image/gif"), ErrPolyglotFile},
+		{"html", html, fileHeader("a.jpg", "image/jpeg"), ErrPolyglotFile},
+	}
+	for _, c := range cases {
+		_, err := ValidateFormat(c.buf, c.header, images)
+		if c.err == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
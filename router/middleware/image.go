@@ -17,14 +17,98 @@ const (
 	ImageQualityAvatar       = "avatar"       // use for avatar upload, small scaled
 	ImageQualityOrganization = "organization" // use for upload organization image, crop down to the largest size available
 	ImageQualityCustom       = "custom"       // custom defined image options
+	ImageQualityDefault      = "default"      // anything else, cut the size in half
 )
 
 var (
 	ErrImageSizeTooLarge      = errors.New("image size too large") // Image width and height too large
 	ErrImageDecodeFailed      = errors.New("image decode failed")  // Cannot decode image
 	ErrImageHeaderCheckFailed = errors.New("image header check failed")
+	ErrImageTooManyPixels     = errors.New("image has too many pixels")
+	ErrImageTooManyFrames     = errors.New("image has too many frames")
+	ErrImageMemoryLimit       = errors.New("image needs too much memory to be processed")
 )
 
+const (
+	// 40 megapixels, a bit more than a 8K 16:9 image
+	DefaultMaxMegapixels = 40
+	// Memory a single image is allowed to take while being processed
+	DefaultMaxImageMemory = 512 * 1024 * 1024
+)
+
+// Max number of frames per animated format
+var DefaultMaxFrames = map[string]int{
+	util.FormatGif:  300,
+	util.FormatPng:  100,
+	util.FormatWebp: 300,
+}
+
+/*
+Limits checked against the image header before anything is decoded or queued,
+so a tiny compressed file can't expand into gigabytes of pixels.
+Zero values fall back to the defaults.
+*/
+type ImageLimits struct {
+	// Max width * height, in millions of pixels
+	MaxMegapixels float64
+
+	// Max number of frames per animated format, see util.CountFrames
+	MaxFrames map[string]int
+
+	// Max estimated memory in bytes needed to decode, resize and encode the image
+	MaxMemory int64
+}
+
+func (l ImageLimits) withDefaults() ImageLimits {
+	if l.MaxMegapixels <= 0 {
+		l.MaxMegapixels = DefaultMaxMegapixels
+	}
+	if l.MaxFrames == nil {
+		l.MaxFrames = DefaultMaxFrames
+	}
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = DefaultMaxImageMemory
+	}
+	return l
+}
+
+/*
+Rough estimation of the memory needed by the processor: the decoded frame,
+the resized copy of it (at most as large as the decoded one) and the output buffer.
+Animated images are decoded frame by frame so the frame count doesn't matter here.
+*/
+func EstimateImageMemory(header *lilliput.ImageHeader) int64 {
+	pixelType := header.PixelType()
+	bytesPerPixel := int64(pixelType.Channels() * pixelType.Depth() / 8)
+	if bytesPerPixel <= 0 {
+		bytesPerPixel = 4
+	}
+	frame := int64(header.Width()) * int64(header.Height()) * bytesPerPixel
+	return 2*frame + processor.DefaultImageBufferSize*1024*1024
+}
+
+// Check the header against the limits, returns the error code on failure, see util.ErrorCatalog for its status
+func (l ImageLimits) Check(header *lilliput.ImageHeader, buf []byte) (string, error) {
+	pixels := float64(header.Width()) * float64(header.Height())
+	if pixels > l.MaxMegapixels*1000*1000 {
+		return util.ErrCodeImageTooLarge,
+			fmt.Errorf("%v: %dx%d", ErrImageTooManyPixels, header.Width(), header.Height())
+	}
+
+	if format, frames := util.CountFrames(buf); format != "" {
+		if maxFrames, ok := l.MaxFrames[format]; ok && frames > maxFrames {
+			return util.ErrCodeImageTooManyFrames,
+				fmt.Errorf("%v: %s has %d frames", ErrImageTooManyFrames, format, frames)
+		}
+	}
+
+	if memory := EstimateImageMemory(header); memory > l.MaxMemory {
+		return util.ErrCodeImageMemoryLimit,
+			fmt.Errorf("%v: %d bytes", ErrImageMemoryLimit, memory)
+	}
+	return "", nil
+}
+
 func NormalizeSizeByScaleFactor(origWidth, origHeight, maxSize int, scaleFactor float64) (int, int, error) {
 	divisor := float64(maxSize) * scaleFactor
 	floatWidth, floatHeight := float64(origWidth), float64(origHeight)
@@ -86,7 +170,7 @@ func ImageQualityDefaultGenerator(header *lilliput.ImageHeader, maxSize int) (*p
 			return &processor.ImageOptions{
 				ImageType: processor.ImageTypeJpeg,
 				Width:     newWidth,
-				Height:    newWidth,
+				Height:    newHeight,
 				Resize:    true,
 			}, nil
 		}
@@ -125,45 +209,86 @@ func ImageOptionsGenerator(header *lilliput.ImageHeader, quality string, maxSize
 	}
 }
 
+// Name of the preset applied for the requested quality
+func ImagePreset(quality string) string {
+	switch quality {
+	case ImageQualityAvatar, ImageQualityOrganization:
+		return quality
+	default:
+		return ImageQualityDefault
+	}
+}
+
 type ImageDecoder struct {
 	FileField    string
 	OptionsField string
 	DataField    string
 	MaxSize      int
+	ImageLimits
+
+	// Presets which get the processor watermark,
+	// requests made with the special token never get it
+	WatermarkPresets map[string]bool
 }
 
-func NewImageDecoder(maxSize int, fileField, optsField, dataField string) ImageDecoder {
+func NewImageDecoder(maxSize int, limits ImageLimits, fileField, optsField, dataField string, watermarkPresets ...string) ImageDecoder {
+	presets := make(map[string]bool, len(watermarkPresets))
+	for _, preset := range watermarkPresets {
+		presets[preset] = true
+	}
 	return ImageDecoder{
-		FileField:    fileField,
-		OptionsField: optsField,
-		DataField:    dataField,
-		MaxSize:      maxSize,
+		FileField:        fileField,
+		OptionsField:     optsField,
+		DataField:        dataField,
+		MaxSize:          maxSize,
+		ImageLimits:      limits.withDefaults(),
+		WatermarkPresets: presets,
 	}
 }
 
 func (i ImageDecoder) Decode(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		data, err := lilliput.NewDecoder(*(r.Context().Value(i.FileField).(*[]byte)))
+		buf := *(r.Context().Value(i.FileField).(*[]byte))
+		data, err := lilliput.NewDecoder(buf)
 		if err != nil {
-			util.WriteBadRequestResponse(w, fmt.Errorf("%v: %v", ErrImageDecodeFailed, err))
+			util.WriteErrorResponse(w, util.ErrCodeImageDecodeFailed, fmt.Errorf("%v: %v", ErrImageDecodeFailed, err))
 			return
 		}
+		// the decoder holds cgo memory, it's closed unless handed to the next handler
+		handedOff := false
+		defer func() {
+			if !handedOff {
+				data.Close()
+			}
+		}()
 
 		// Check file header to ensure that the file is ok
 		header, err := data.Header()
 		if err != nil {
-			util.WriteBadRequestResponse(w, fmt.Errorf("%v: %v", ErrImageHeaderCheckFailed, err))
+			util.WriteErrorResponse(w, util.ErrCodeImageDecodeFailed, fmt.Errorf("%v: %v", ErrImageHeaderCheckFailed, err))
+			return
+		}
+
+		if code, err := i.Check(header, buf); err != nil {
+			util.WriteErrorResponse(w, code, err)
 			return
 		}
 
 		quality := r.FormValue(ImageQualityField)
+		if p := PrincipalFromContext(r.Context()); p != nil && !p.AllowsPreset(ImagePreset(quality)) {
+			util.WriteErrorResponse(w, util.ErrCodePresetNotAllowed, fmt.Errorf("image options: %v: %s", ErrPresetNotAllowed, ImagePreset(quality)))
+			return
+		}
 		opts, err := ImageOptionsGenerator(header, quality, i.MaxSize)
-
 		if err != nil {
-			util.WriteServerErrorResponse(w, fmt.Errorf("image options: %v", err))
+			// the generators only fail on images too large for the preset
+			util.WriteErrorResponse(w, util.ErrCodeImageTooLarge, fmt.Errorf("image options: %v", err))
 			return
 		}
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(context.WithValue(context.Background(), i.OptionsField, opts), i.DataField, &data)))
+		opts.Watermark = i.WatermarkPresets[ImagePreset(quality)] && !IsSpecialRequest(r.Context())
+		handedOff = true
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(context.WithValue(r.Context(), i.OptionsField, opts), i.DataField, &data)))
 	})
 }
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"github.com/aperture147/mediaproxy/util"
+	"github.com/discord/lilliput"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func generateGif(t *testing.T, width, height, frames int) []byte {
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageLimitsCheck(t *testing.T) {
+	cases := []struct {
+		name   string
+		limits ImageLimits
+		width  int
+		height int
+		frames int
+		status int
+		code   string
+	}{
+		{"ok", ImageLimits{}, 64, 64, 3, 0, ""},
+		{"pixels", ImageLimits{MaxMegapixels: 0.001}, 64, 64, 1, http.StatusRequestEntityTooLarge, util.ErrCodeImageTooLarge},
+		{"frames", ImageLimits{MaxFrames: map[string]int{util.FormatGif: 2}}, 16, 16, 3, http.StatusUnprocessableEntity, util.ErrCodeImageTooManyFrames},
+		{"memory", ImageLimits{MaxMemory: 1024}, 16, 16, 1, http.StatusRequestEntityTooLarge, util.ErrCodeImageMemoryLimit},
+	}
+	for _, c := range cases {
+		buf := generateGif(t, c.width, c.height, c.frames)
+		if format, frames := util.CountFrames(buf); format != util.FormatGif || frames != c.frames {
+			t.Fatalf("%s: expected %d gif frames, got %d %s", c.name, c.frames, frames, format)
+		}
+		decoder, err := lilliput.NewDecoder(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := decoder.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := c.limits.withDefaults().Check(header, buf)
+		status := util.ErrorCatalog[code].Status
+		if status != c.status || code != c.code {
+			t.Errorf("%s: expected %d %q, got %d %q (%v)", c.name, c.status, c.code, status, code, err)
+		}
+		decoder.Close()
+	}
+}
+
+func decodeHeader(t *testing.T, buf []byte) *lilliput.ImageHeader {
+	decoder, err := lilliput.NewDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	header, err := decoder.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestImageQualityDefaultGeneratorAspectRatio(t *testing.T) {
+	opts, err := ImageQualityDefaultGenerator(decodeHeader(t, generateGif(t, 64, 32, 1)), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Width != 32 || opts.Height != 16 {
+		t.Fatalf("expected 32x16, got %dx%d", opts.Width, opts.Height)
+	}
+}
+
+func TestImageDecoderOptionsError(t *testing.T) {
+	buf := generateGif(t, 64, 64, 1)
+	decoder := NewImageDecoder(70, ImageLimits{}, "file", "options", "data")
+	handler := decoder.Decode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("the image is too large for the organization preset")
+	}))
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField(ImageQualityField, ImageQualityOrganization)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req = req.WithContext(context.WithValue(req.Context(), "file", &buf))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), util.ErrCodeImageTooLarge) {
+		t.Fatalf("expected 413 %s, got %d: %s", util.ErrCodeImageTooLarge, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Default delay between two fetches of a remote JWKS
+	DefaultJWKSRefreshInterval = 10 * time.Minute
+	DefaultJWKSFetchTimeout    = 10 * time.Second
+	// A larger JWK set is truncated and fails to parse
+	MaxJWKSSize = 1024 * 1024
+)
+
+var (
+	ErrUnknownKey     = errors.New("unknown key")
+	ErrUnsupportedKey = errors.New("unsupported key")
+)
+
+// Gives the key verifying a token signed with alg by the key kid
+type KeySource interface {
+	Key(alg, kid string) (interface{}, error)
+}
+
+// Shared secret for HS256 tokens
+type HMACKeySource []byte
+
+func (s HMACKeySource) Key(alg, _ string) (interface{}, error) {
+	if alg != AlgHS256 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+	return []byte(s), nil
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("%w: type %s", ErrUnsupportedKey, k.KeyType)
+}
+
+// Parse a JWK set, keys of an unsupported type are skipped
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if errors.Is(err, ErrUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %s: %v", k.KeyID, err)
+		}
+		keys[k.KeyID] = key
+	}
+	return keys, nil
+}
+
+/*
+RS256 and ES256 public keys published as a JWK set, either read once from a file
+or fetched from an url. Remote sets are fetched again every RefreshInterval,
+or earlier when a token refers to an unknown key (at most once a minute),
+so rotated keys are picked up without restarting. Lookups keep using the
+previous keys while a fetch is running, unless there are none yet.
+*/
+type JWKSKeySource struct {
+	URL             string
+	RefreshInterval time.Duration
+	// nil uses a client timing out after DefaultJWKSFetchTimeout
+	Client *http.Client
+
+	mutex     sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	fetching  chan struct{} // closed once the running fetch is done, nil when there is none
+}
+
+func NewJWKSFileKeySource(path string) (*JWKSKeySource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKSKeySource{keys: keys}, nil
+}
+
+func NewJWKSURLKeySource(url string) *JWKSKeySource {
+	return &JWKSKeySource{
+		URL:             url,
+		RefreshInterval: DefaultJWKSRefreshInterval,
+		Client:          &http.Client{Timeout: DefaultJWKSFetchTimeout},
+	}
+}
+
+// Download and parse the set, without holding the mutex
+func (s *JWKSKeySource) fetch() (map[string]interface{}, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultJWKSFetchTimeout}
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: unexpected status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	return ParseJWKS(data)
+}
+
+// Fetch the set again unless it was fetched less than a minute ago, waiting for the fetch already running
+func (s *JWKSKeySource) refresh() error {
+	s.mutex.Lock()
+	if done := s.fetching; done != nil {
+		s.mutex.Unlock()
+		<-done
+		return nil
+	}
+	// don't let tokens with random kid hammer the jwks endpoint
+	if time.Since(s.fetchedAt) <= time.Minute {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.fetchedAt = time.Now()
+	done := make(chan struct{})
+	s.fetching = done
+	s.mutex.Unlock()
+
+	keys, err := s.fetch()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		s.keys = keys
+	}
+	s.fetching = nil
+	close(done)
+	return err
+}
+
+func (s *JWKSKeySource) Key(_, kid string) (interface{}, error) {
+	s.mutex.RLock()
+	key, ok := s.keys[kid]
+	stale := s.URL != "" && time.Since(s.fetchedAt) > s.RefreshInterval
+	s.mutex.RUnlock()
+	if ok && !stale {
+		return key, nil
+	}
+	if s.URL == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, kid)
+	}
+
+	err := s.refresh()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if err != nil && s.keys == nil {
+		return nil, err
+	}
+	if key, ok = s.keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
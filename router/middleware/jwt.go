@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/util"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// Clock skew tolerated on exp and nbf
+const DefaultJWTLeeway = 30 * time.Second
+
+var (
+	ErrMalformedToken       = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrTokenExpired         = errors.New("token expired")
+	ErrTokenNotYetValid     = errors.New("token not valid yet")
+	ErrWrongIssuer          = errors.New("wrong issuer")
+	ErrWrongAudience        = errors.New("wrong audience")
+)
+
+// aud can either be a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+
+	// Space separated scopes (RFC 8693), "scopes" is accepted as an array too
+	Scope  string   `json:"scope"`
+	Scopes []string `json:"scopes"`
+
+	MaxFileSize   int64    `json:"max_file_size"` // in bytes
+	Presets       []string `json:"presets"`
+	StoragePrefix string   `json:"storage_prefix"`
+	Tier          string   `json:"tier"`
+}
+
+func (c *Claims) Principal() *Principal {
+	scopes := append(strings.Fields(c.Scope), c.Scopes...)
+	return &Principal{
+		Subject:       c.Subject,
+		Scopes:        scopes,
+		MaxFileSize:   c.MaxFileSize,
+		Presets:       c.Presets,
+		StoragePrefix: c.StoragePrefix,
+		Tier:          c.Tier,
+	}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Bearer token authenticator verifying HS256, RS256 and ES256 signed jwt
+type JWTAuthenticator struct {
+	Keys KeySource
+
+	// Expected iss and aud claims, empty skips the check
+	Issuer   string
+	Audience string
+
+	Leeway time.Duration
+}
+
+func NewJWTAuthenticator(keys KeySource, issuer, audience string) JWTAuthenticator {
+	return JWTAuthenticator{
+		Keys:     keys,
+		Issuer:   issuer,
+		Audience: audience,
+		Leeway:   DefaultJWTLeeway,
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func verifySignature(alg string, key interface{}, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	// the key type must match the algorithm, otherwise a public key could be used as an hmac secret
+	switch k := key.(type) {
+	case []byte:
+		if alg != AlgHS256 {
+			return ErrUnsupportedAlgorithm
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != AlgRS256 {
+			return ErrUnsupportedAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != AlgES256 {
+			return ErrUnsupportedAlgorithm
+		}
+		// jws ecdsa signatures are r || s, 32 bytes each for P-256
+		if len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// Parse the token, check its signature and its registered claims
+func (a JWTAuthenticator) Parse(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+	switch header.Algorithm {
+	case AlgHS256, AlgRS256, AlgES256:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+	key, err := a.Keys.Key(header.Algorithm, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(a.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(a.Leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrTokenNotYetValid
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, ErrWrongIssuer
+	}
+	if a.Audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			found = found || aud == a.Audience
+		}
+		if !found {
+			return nil, ErrWrongAudience
+		}
+	}
+	return &claims, nil
+}
+
+func (a JWTAuthenticator) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			util.WriteForbiddenResponse(w, fmt.Errorf("jwt: %v", ErrNoToken))
+			return
+		}
+
+		rawAuth := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(rawAuth) != 2 || rawAuth[0] != "Bearer" {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("jwt: %v", ErrWrongToken))
+			return
+		}
+
+		claims, err := a.Parse(rawAuth[1])
+		if err != nil {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("jwt: %v: %v", ErrWrongToken, err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), claims.Principal())))
+	})
+}
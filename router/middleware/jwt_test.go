@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":            "user-1",
+		"iss":            "auth.example.com",
+		"aud":            []string{"mediaproxy"},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"scope":          "image:upload special",
+		"max_file_size":  1024,
+		"presets":        []string{"avatar"},
+		"storage_prefix": "users/1",
+	}
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	secret := []byte("secret")
+	auth := NewJWTAuthenticator(HMACKeySource(secret), "auth.example.com", "mediaproxy")
+
+	claims, err := auth.Parse(signToken(t, AlgHS256, "", secret, validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := claims.Principal()
+	if p.Subject != "user-1" || !p.HasScope(ScopeImageUpload) || !p.HasScope(ScopeSpecial) || p.HasScope(ScopeAudioUpload) {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+	if p.MaxFileSize != 1024 || !p.AllowsPreset("avatar") || p.AllowsPreset("organization") {
+		t.Fatalf("unexpected limits %+v", p)
+	}
+	if p.StoragePath("abc") != "users/1/abc" {
+		t.Fatalf("unexpected storage path %s", p.StoragePath("abc"))
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "someone-else"
+
+	failures := []struct {
+		token string
+		err   error
+	}{
+		{signToken(t, AlgHS256, "", []byte("wrong"), validClaims()), ErrInvalidSignature},
+		{signToken(t, AlgHS256, "", secret, expired), ErrTokenExpired},
+		{signToken(t, AlgHS256, "", secret, wrongAudience), ErrWrongAudience},
+		{signToken(t, "none", "", secret, validClaims()), ErrUnsupportedAlgorithm},
+		{"not.a.token", ErrMalformedToken},
+	}
+	for i, f := range failures {
+		if _, err = auth.Parse(f.token); !errors.Is(err, f.err) {
+			t.Errorf("case %d: expected %v, got %v", i, f.err, err)
+		}
+	}
+}
+
+func TestJWTAuthenticatorJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","n":"%s","e":"%s"},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"OKP","kid":"ed","crv":"Ed25519","x":"AA"}
+	]}`, encodeInt(rsaKey.N), encodeInt(big.NewInt(int64(rsaKey.E))), encodeInt(ecKey.X), encodeInt(ecKey.Y))
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = ioutil.WriteFile(path, []byte(jwks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileKeys, err := NewJWKSFileKeySource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jwks))
+	}))
+	defer server.Close()
+
+	for _, keys := range []KeySource{fileKeys, NewJWKSURLKeySource(server.URL)} {
+		auth := NewJWTAuthenticator(keys, "", "")
+		if _, err = auth.Parse(signToken(t, AlgRS256, "rsa", rsaKey, validClaims())); err != nil {
+			t.Fatalf("rs256: %v", err)
+		}
+		if _, err = auth.Parse(signToken(t, AlgES256, "ec", ecKey, validClaims())); err != nil {
+			t.Fatalf("es256: %v", err)
+		}
+		// an rsa key must not verify a token claiming another algorithm
+		if _, err = auth.Parse(signToken(t, AlgES256, "rsa", ecKey, validClaims())); !errors.Is(err, ErrUnsupportedAlgorithm) {
+			t.Fatalf("expected algorithm mismatch, got %v", err)
+		}
+		if _, err = auth.Parse(signToken(t, AlgRS256, "missing", rsaKey, validClaims())); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected unknown key, got %v", err)
+		}
+	}
+}
+
+func TestJWKSURLKeySourceTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	keys := NewJWKSURLKeySource(server.URL)
+	keys.Client.Timeout = 50 * time.Millisecond
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := keys.Key(AlgRS256, "rsa")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the lookup is stuck behind the hanging jwks endpoint")
+		}
+	}
+}
+
+func TestJWTAuthenticatorVerify(t *testing.T) {
+	secret := []byte("secret")
+	auth := NewJWTAuthenticator(HMACKeySource(secret), "", "")
+	audioOnly := NewScopeVerifier(ScopeAudioUpload)
+
+	var principal *Principal
+	handler := auth.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, AlgHS256, "", secret, validClaims()))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "user-1" {
+		t.Fatalf("principal not propagated: %+v", principal)
+	}
+
+	w := httptest.NewRecorder()
+	auth.Verify(audioOnly.Verify(http.NotFoundHandler())).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without the audio scope, got %d", w.Code)
+	}
+}
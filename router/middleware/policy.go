@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/util"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Query parameter or multipart field carrying the signed policy
+const PolicyField = "policy"
+
+// Header carrying the signed policy, for the clients which can't touch the url
+const PolicyHeader = "X-Upload-Policy"
+
+const (
+	DefaultPolicyTTL = 15 * time.Minute
+	MaxPolicyTTL     = time.Hour
+
+	// Bytes of the multipart body read before authenticating while looking for the policy field,
+	// the field has to come first, before the file
+	DefaultPolicyMaxFormSize = 8 * 1024
+)
+
+var (
+	ErrMalformedPolicy = errors.New("malformed policy")
+	ErrPolicyExpired   = errors.New("policy expired")
+	ErrPolicySignature = errors.New("invalid policy signature")
+	ErrUnknownRouter   = errors.New("unknown router")
+	ErrNoTenantStorage = errors.New("tenant storage not found")
+)
+
+/*
+Short lived permission to upload a single kind of file, minted by a trusted backend
+and handed to a browser, which can then post directly to mediaproxy without
+going through the backend to attach a bearer token.
+*/
+type UploadPolicy struct {
+	// Who the policy was minted for
+	Subject string `json:"sub"`
+
+	// Router the policy is valid for, see the tenant Router constants
+	Router string `json:"router"`
+
+	// Preset the upload has to use, empty allows every preset
+	Preset string `json:"preset,omitempty"`
+
+	// Max upload size in bytes, 0 keeps the router limit
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+
+	// Tenant and tier of the principal which minted the policy, uploads count against their limits
+	TenantID string `json:"tenant_id,omitempty"`
+	Tier     string `json:"tier,omitempty"`
+
+	// The tenant has a backend of its own, the uploads must go there rather than to the router storage
+	TenantStorage bool `json:"tenant_storage,omitempty"`
+
+	// Unix timestamp after which the policy is rejected
+	ExpiresAt int64 `json:"exp"`
+}
+
+func (p *UploadPolicy) Principal() *Principal {
+	principal := &Principal{
+		Subject:       "policy:" + p.Subject,
+		Scopes:        []string{TenantRouterScopes[p.Router]},
+		MaxFileSize:   p.MaxFileSize,
+		StoragePrefix: p.StoragePrefix,
+		TenantID:      p.TenantID,
+		Tier:          p.Tier,
+	}
+	if p.Preset != "" {
+		principal.Presets = []string{p.Preset}
+	}
+	return principal
+}
+
+func signPolicyPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encode and sign a policy, the result is url safe
+func SignPolicy(secret []byte, policy UploadPolicy) (string, error) {
+	if _, ok := TenantRouterScopes[policy.Router]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRouter, policy.Router)
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signPolicyPayload(secret, payload), nil
+}
+
+// Check the signature and the expiration of a signed policy
+func ParsePolicy(secret []byte, signed string) (*UploadPolicy, error) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return nil, ErrMalformedPolicy
+	}
+	if !hmac.Equal([]byte(signPolicyPayload(secret, parts[0])), []byte(parts[1])) {
+		return nil, ErrPolicySignature
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPolicy, err)
+	}
+	var policy UploadPolicy
+	if err = json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPolicy, err)
+	}
+	if _, ok := TenantRouterScopes[policy.Router]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRouter, policy.Router)
+	}
+	if time.Now().After(time.Unix(policy.ExpiresAt, 0)) {
+		return nil, ErrPolicyExpired
+	}
+	return &policy, nil
+}
+
+/*
+Accept a signed upload policy passed as the policy query parameter, the X-Upload-Policy header
+or the first field of a multipart form. Only MaxFormSize bytes of the form are read before
+the policy is checked, they are handed back to the next handler along with the rest of the body.
+Requests carrying no policy at all are handed to the Bearer authenticator,
+so browsers and backends can share the same upload route.
+*/
+type PolicyAuthenticator struct {
+	Secret      []byte
+	Bearer      Authenticator
+	MaxFormSize int64
+
+	// Backend of a tenant, e.g. tenant.FileRegistry.Storage. Policies of a tenant
+	// with a backend of its own are rejected when it can't be found
+	TenantStorage func(tenantID string) storage.Storage
+}
+
+func NewPolicyAuthenticator(secret []byte, bearer Authenticator) PolicyAuthenticator {
+	return PolicyAuthenticator{
+		Secret:      secret,
+		Bearer:      bearer,
+		MaxFormSize: DefaultPolicyMaxFormSize,
+	}
+}
+
+/*
+Read the policy field when it's the first part of the multipart body, within limit bytes.
+The body is rewound whatever happens, an empty policy is returned when there is none.
+*/
+func policyFromForm(r *http.Request, limit int64) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return ""
+	}
+	read := new(bytes.Buffer)
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(read, body), body}
+	}()
+
+	form := multipart.NewReader(io.TeeReader(io.LimitReader(body, limit), read), params["boundary"])
+	part, err := form.NextPart()
+	if err != nil || part.FormName() != PolicyField {
+		return ""
+	}
+	signed, err := ioutil.ReadAll(part)
+	if err != nil {
+		return ""
+	}
+	return string(signed)
+}
+
+func (pa PolicyAuthenticator) Verify(next http.Handler) http.Handler {
+	bearer := pa.Bearer.Verify(next)
+	if pa.MaxFormSize <= 0 {
+		pa.MaxFormSize = DefaultPolicyMaxFormSize
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed := r.URL.Query().Get(PolicyField)
+		if signed == "" {
+			signed = r.Header.Get(PolicyHeader)
+		}
+		if signed == "" && r.Header.Get("Authorization") == "" &&
+			strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			signed = policyFromForm(r, pa.MaxFormSize)
+		}
+		if signed == "" {
+			bearer.ServeHTTP(w, r)
+			return
+		}
+
+		policy, err := ParsePolicy(pa.Secret, signed)
+		if err != nil {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("policy: %v", err))
+			return
+		}
+		principal := policy.Principal()
+		if policy.TenantStorage {
+			if pa.TenantStorage != nil {
+				principal.Storage = pa.TenantStorage(policy.TenantID)
+			}
+			if principal.Storage == nil {
+				util.WriteUnauthorizedResponse(w, fmt.Errorf("policy: %v: %s", ErrNoTenantStorage, policy.TenantID))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
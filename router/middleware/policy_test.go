@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aperture147/mediaproxy/tenant"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignPolicy(t *testing.T) {
+	secret := []byte("secret")
+	policy := UploadPolicy{
+		Subject:     "backend",
+		Router:      tenant.RouterImage,
+		Preset:      "avatar",
+		MaxFileSize: 1024,
+		ExpiresAt:   time.Now().Add(time.Minute).Unix(),
+	}
+	signed, err := SignPolicy(secret, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePolicy(secret, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != policy {
+		t.Fatalf("expected %+v, got %+v", policy, parsed)
+	}
+
+	p := parsed.Principal()
+	if !p.HasScope(ScopeImageUpload) || p.HasScope(ScopeAudioUpload) || !p.AllowsPreset("avatar") || p.AllowsPreset("organization") {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+
+	if _, err = ParsePolicy([]byte("other"), signed); !errors.Is(err, ErrPolicySignature) {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+	policy.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired, _ := SignPolicy(secret, policy)
+	if _, err = ParsePolicy(secret, expired); !errors.Is(err, ErrPolicyExpired) {
+		t.Fatalf("expected an expired policy, got %v", err)
+	}
+}
+
+func TestPolicyAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	signed, err := SignPolicy(secret, UploadPolicy{
+		Subject:   "backend",
+		Router:    tenant.RouterAudio,
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewPolicyAuthenticator(secret, NewTokenAuthenticator())
+	var principal *Principal
+	var file string
+	handler := auth.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
+		if f, _, err := r.FormFile("file"); err == nil {
+			data, _ := ioutil.ReadAll(f)
+			file = string(data)
+		}
+	}))
+
+	// query parameter
+	req := httptest.NewRequest(http.MethodPost, "/?policy="+url.QueryEscape(signed), nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "policy:backend" || !principal.HasScope(ScopeAudioUpload) {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+
+	// header
+	principal = nil
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(PolicyHeader, signed)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "policy:backend" {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+
+	// multipart field before the file, the file is still readable by the next handler
+	principal = nil
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField(PolicyField, signed)
+	part, _ := form.CreateFormFile("file", "a.mp3")
+	part.Write([]byte("audio"))
+	form.Close()
+	req = httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "policy:backend" || file != "audio" {
+		t.Fatalf("unexpected principal %+v and file %q", principal, file)
+	}
+
+	// multipart field after a file larger than the pre-auth limit isn't looked for
+	principal = nil
+	body = new(bytes.Buffer)
+	form = multipart.NewWriter(body)
+	part, _ = form.CreateFormFile("file", "a.mp3")
+	part.Write(make([]byte, DefaultPolicyMaxFormSize))
+	form.WriteField(PolicyField, signed)
+	form.Close()
+	req = httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if principal != nil || w.Code != http.StatusForbidden {
+		t.Fatalf("expected the bearer authenticator to answer 403, got %d and principal %+v", w.Code, principal)
+	}
+
+	// no policy, the bearer authenticator takes over
+	principal = nil
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+NewTokenAuthenticator().Token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "token" {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+
+	// tampered policy
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?policy=x"+url.QueryEscape(signed), nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/util"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const PrincipalKey = "principal"
+
+const (
+	ScopeImageUpload = "image:upload"
+	ScopeAudioUpload = "audio:upload"
+	// Grant some special actions like skipping the watermark
+	// or override some default settings
+	ScopeSpecial = "special"
+	// Runtime tuning of the processors, see the admin router
+	ScopeAdmin = "admin"
+)
+
+var (
+	ErrMissingScope     = errors.New("missing scope")
+	ErrPresetNotAllowed = errors.New("preset not allowed")
+	ErrNoPrincipal      = errors.New("request is not authenticated")
+)
+
+// Every authenticator verifies its credentials then puts one of these in the request context
+type Principal struct {
+	// Who is making the request, e.g. the jwt subject
+	Subject string
+
+	Scopes []string
+
+	// Max upload size in bytes, 0 keeps the router limit. It can only lower the router limit
+	MaxFileSize int64
+
+	// Presets the principal may use, empty allows every preset
+	Presets []string
+
+	// Prepended to the name of every file saved for the principal
+	StoragePrefix string
+
+	// Tenant the principal belongs to, empty for single tenant authenticators
+	TenantID string
+
+	// Rate limit tier, see RateLimiter
+	Tier string
+
+	// Backend the principal files are saved to, nil keeps the router storage
+	Storage storage.Storage
+}
+
+type Authenticator interface {
+	Verify(next http.Handler) http.Handler
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) AllowsPreset(preset string) bool {
+	if len(p.Presets) == 0 {
+		return true
+	}
+	for _, s := range p.Presets {
+		if s == preset {
+			return true
+		}
+	}
+	return false
+}
+
+// Path of a file saved for the principal, the prefix can't escape the storage root
+func (p *Principal) StoragePath(fileName string) string {
+	if p.StoragePrefix == "" {
+		return fileName
+	}
+	prefix := strings.TrimPrefix(path.Clean("/"+p.StoragePrefix), "/")
+	return path.Join(prefix, fileName)
+}
+
+// Principals of a tenant share their limits, the others are limited on their own
+func (p *Principal) RateLimitKey() string {
+	if p.TenantID != "" {
+		return "tenant:" + p.TenantID
+	}
+	return p.Subject
+}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, PrincipalKey, p)
+}
+
+// Returns nil when the request didn't go through an authenticator
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(PrincipalKey).(*Principal)
+	return p
+}
+
+func IsSpecialRequest(ctx context.Context) bool {
+	p := PrincipalFromContext(ctx)
+	return p != nil && p.HasScope(ScopeSpecial)
+}
+
+// Reject principals which don't carry the scope
+type ScopeVerifier struct {
+	Scope string
+}
+
+func NewScopeVerifier(scope string) ScopeVerifier {
+	return ScopeVerifier{scope}
+}
+
+func (sv ScopeVerifier) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		if p == nil {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("scope: %v", ErrNoPrincipal))
+			return
+		}
+		if !p.HasScope(sv.Scope) {
+			util.WriteForbiddenResponse(w, fmt.Errorf("scope: %v: %s", ErrMissingScope, sv.Scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
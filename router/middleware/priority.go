@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"github.com/aperture147/mediaproxy/processor"
+	"net/http"
+	"strings"
+)
+
+// Header letting a client pick the priority of its upload, e.g. low for bulk imports
+const PriorityHeader = "X-Priority"
+
+// Priority of each tier, it's also the highest priority the tier may ask for
+var DefaultTierPriorities = map[string]int{
+	TierDefault: processor.PriorityNormal,
+	TierSpecial: processor.PriorityHigh,
+}
+
+// Interactive uploads go before everything else
+var DefaultPresetPriorities = map[string]int{
+	ImageQualityAvatar: processor.PriorityHigh,
+}
+
+/*
+Pick the scheduling of the jobs of a request. The priority comes from the preset
+when it has one, from the principal tier otherwise. The PriorityHeader can only
+lower it, nobody gets ahead of the queue by asking.
+Jobs are fairly shared between principals of the same priority.
+*/
+type Prioritizer struct {
+	TierPriorities   map[string]int
+	PresetPriorities map[string]int
+}
+
+// nil maps fall back to the default priorities
+func NewPrioritizer(tierPriorities, presetPriorities map[string]int) Prioritizer {
+	if tierPriorities == nil {
+		tierPriorities = DefaultTierPriorities
+	}
+	if presetPriorities == nil {
+		presetPriorities = DefaultPresetPriorities
+	}
+	return Prioritizer{
+		TierPriorities:   tierPriorities,
+		PresetPriorities: presetPriorities,
+	}
+}
+
+func (pr Prioritizer) Scheduling(r *http.Request, preset string) processor.Scheduling {
+	s := processor.Scheduling{Priority: processor.PriorityNormal}
+	p := PrincipalFromContext(r.Context())
+	if p != nil {
+		s.Key = p.RateLimitKey()
+		if priority, ok := pr.TierPriorities[p.Tier]; ok {
+			s.Priority = priority
+		}
+	}
+	if priority, ok := pr.PresetPriorities[preset]; ok {
+		s.Priority = priority
+	}
+
+	if requested, ok := processor.ParsePriority(strings.ToLower(r.Header.Get(PriorityHeader))); ok && requested < s.Priority {
+		s.Priority = requested
+	}
+	return s
+}
+
+// Request context carrying the scheduling, to be given to the processor Add functions
+func (pr Prioritizer) Context(r *http.Request, preset string) context.Context {
+	return processor.WithScheduling(r.Context(), pr.Scheduling(r, preset))
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"github.com/aperture147/mediaproxy/processor"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrioritizerScheduling(t *testing.T) {
+	pr := NewPrioritizer(nil, nil)
+	cases := []struct {
+		principal *Principal
+		preset    string
+		header    string
+		expected  int
+	}{
+		{nil, ImageQualityDefault, "", processor.PriorityNormal},
+		{&Principal{Subject: "a", Tier: TierDefault}, ImageQualityDefault, "", processor.PriorityNormal},
+		{&Principal{Subject: "a", Tier: TierSpecial}, ImageQualityDefault, "", processor.PriorityHigh},
+		{&Principal{Subject: "a", Tier: TierDefault}, ImageQualityAvatar, "", processor.PriorityHigh},
+		{&Principal{Subject: "a", Tier: TierDefault}, ImageQualityDefault, "low", processor.PriorityLow},
+		{&Principal{Subject: "a", Tier: TierDefault}, ImageQualityDefault, "HIGH", processor.PriorityNormal},
+		{&Principal{Subject: "a", Tier: TierDefault}, ImageQualityDefault, "urgent", processor.PriorityNormal},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("POST", "/image", nil)
+		if c.header != "" {
+			r.Header.Set(PriorityHeader, c.header)
+		}
+		if c.principal != nil {
+			r = r.WithContext(WithPrincipal(r.Context(), c.principal))
+		}
+		s := pr.Scheduling(r, c.preset)
+		if s.Priority != c.expected {
+			t.Errorf("case %d: expected priority %d, got %d", i, c.expected, s.Priority)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/image", nil)
+	r = r.WithContext(WithPrincipal(r.Context(), &Principal{Subject: "sub", TenantID: "acme"}))
+	if s := pr.Scheduling(r, ""); s.Key != "tenant:acme" {
+		t.Errorf("expected tenant key, got %q", s.Key)
+	}
+}
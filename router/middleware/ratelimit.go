@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/util"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	TierDefault = "default"
+	TierSpecial = "special"
+)
+
+// Limiter state of a principal idle for this long is dropped
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+const inFlightKey = "rateLimitInFlight"
+
+var (
+	ErrRateLimited    = errors.New("rate limit exceeded")
+	ErrTooManyUploads = errors.New("too many uploads in flight")
+)
+
+type RateLimit struct {
+	// Sustained requests per second, 0 disables the rate limit
+	Rate float64
+
+	// Requests allowed in a burst above the rate
+	Burst int
+
+	// Max uploads being processed at the same time, 0 disables the limit
+	MaxInFlight int
+}
+
+type rateLimiterState struct {
+	limit    RateLimit // applied to the limiter, updated when the tier of the key changes
+	limiter  *rate.Limiter
+	inFlight int
+	lastSeen time.Time
+}
+
+// Apply limit to the state, keeping the tokens left when only the rate or burst changes
+func (s *rateLimiterState) setLimit(now time.Time, limit RateLimit) {
+	s.limit = limit
+	if limit.Rate <= 0 {
+		s.limiter = nil
+		return
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	if s.limiter == nil {
+		s.limiter = rate.NewLimiter(rate.Limit(limit.Rate), burst)
+		return
+	}
+	s.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+	s.limiter.SetBurstAt(now, burst)
+}
+
+// In flight slot of a request, see DetachInFlight
+type inFlightSlot struct {
+	release  func()
+	detached bool
+}
+
+/*
+Take over the in flight slot of the request for work outliving it, e.g. an async job,
+so the slot is only released once the work is done. Call the returned function then,
+it does nothing when the request holds no slot.
+*/
+func DetachInFlight(ctx context.Context) func() {
+	slot, ok := ctx.Value(inFlightKey).(*inFlightSlot)
+	if !ok || slot.detached {
+		return func() {}
+	}
+	slot.detached = true
+	return slot.release
+}
+
+/*
+Token bucket rate limit and concurrent upload quota per principal.
+Principals of a tenant share the same limits, the others are limited by subject.
+Limits are picked by the principal tier, unknown tiers get the Default limit.
+*/
+type RateLimiter struct {
+	Tiers   map[string]RateLimit
+	Default RateLimit
+
+	mutex     sync.Mutex
+	states    map[string]*rateLimiterState
+	lastSweep time.Time
+}
+
+func NewRateLimiter(defaultLimit RateLimit, tiers map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{
+		Tiers:   tiers,
+		Default: defaultLimit,
+		states:  make(map[string]*rateLimiterState),
+	}
+}
+
+func (rl *RateLimiter) limit(tier string) RateLimit {
+	if limit, ok := rl.Tiers[tier]; ok {
+		return limit
+	}
+	return rl.Default
+}
+
+// Drop the state of idle principals, must be called with the mutex held
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimiterIdleTimeout {
+		return
+	}
+	rl.lastSweep = now
+	for key, state := range rl.states {
+		if state.inFlight == 0 && now.Sub(state.lastSeen) > rateLimiterIdleTimeout {
+			delete(rl.states, key)
+		}
+	}
+}
+
+/*
+Take a token and an in flight slot for the key. On success the returned
+function releases the slot, on failure the delay after which the request
+may be retried is returned along with the error.
+*/
+func (rl *RateLimiter) Acquire(key, tier string) (func(), time.Duration, error) {
+	limit := rl.limit(tier)
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.sweep(now)
+
+	state, ok := rl.states[key]
+	if !ok {
+		state = &rateLimiterState{}
+		state.setLimit(now, limit)
+		rl.states[key] = state
+	} else if state.limit != limit {
+		// the tier of the key or the limits of the tier changed
+		state.setLimit(now, limit)
+	}
+	state.lastSeen = now
+
+	if limit.MaxInFlight > 0 && state.inFlight >= limit.MaxInFlight {
+		return nil, time.Second, ErrTooManyUploads
+	}
+	if state.limiter != nil {
+		reservation := state.limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			reservation.CancelAt(now)
+			return nil, delay, ErrRateLimited
+		}
+	}
+
+	state.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.mutex.Lock()
+			state.inFlight--
+			rl.mutex.Unlock()
+		})
+	}, 0, nil
+}
+
+func (rl *RateLimiter) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		if p == nil {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("rate limit: %v", ErrNoPrincipal))
+			return
+		}
+
+		release, retryAfter, err := rl.Acquire(p.RateLimitKey(), p.Tier)
+		if err != nil {
+			code := util.ErrCodeRateLimited
+			if errors.Is(err, ErrTooManyUploads) {
+				code = util.ErrCodeTooManyUploads
+			}
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			util.WriteErrorResponse(w, code, err)
+			return
+		}
+		slot := &inFlightSlot{release: release}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inFlightKey, slot)))
+		if !slot.detached {
+			release()
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterAcquire(t *testing.T) {
+	rl := NewRateLimiter(RateLimit{Rate: 1, Burst: 2}, map[string]RateLimit{
+		TierSpecial: {MaxInFlight: 1},
+	})
+
+	for i := 0; i < 2; i++ {
+		release, _, err := rl.Acquire("a", TierDefault)
+		if err != nil {
+			t.Fatalf("request %d within the burst rejected: %v", i, err)
+		}
+		release()
+	}
+	if _, retryAfter, err := rl.Acquire("a", TierDefault); !errors.Is(err, ErrRateLimited) || retryAfter <= 0 {
+		t.Fatalf("expected a rate limit with a retry delay, got %v %v", err, retryAfter)
+	}
+	// buckets are per key
+	if _, _, err := rl.Acquire("b", TierDefault); err != nil {
+		t.Fatalf("other key rejected: %v", err)
+	}
+
+	release, _, err := rl.Acquire("c", TierSpecial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = rl.Acquire("c", TierSpecial); !errors.Is(err, ErrTooManyUploads) {
+		t.Fatalf("expected the in flight quota to be hit, got %v", err)
+	}
+	release()
+	if _, _, err = rl.Acquire("c", TierSpecial); err != nil {
+		t.Fatalf("released slot not reusable: %v", err)
+	}
+}
+
+func TestRateLimiterVerify(t *testing.T) {
+	rl := NewRateLimiter(RateLimit{Rate: 0.1, Burst: 1}, nil)
+	handler := NewTokenAuthenticator().Verify(rl.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+NewTokenAuthenticator().Token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimiterTierChange(t *testing.T) {
+	rl := NewRateLimiter(RateLimit{Rate: 0.001, Burst: 1}, map[string]RateLimit{
+		"unlimited": {},
+		"fast":      {Rate: 1000, Burst: 5},
+	})
+	if _, _, err := rl.Acquire("a", TierDefault); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rl.Acquire("a", TierDefault); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected a rate limit, got %v", err)
+	}
+	// the key moved to another tier, its limits apply right away
+	for _, tier := range []string{"unlimited", "fast", "fast"} {
+		if _, _, err := rl.Acquire("a", tier); err != nil {
+			t.Fatalf("%s tier not applied: %v", tier, err)
+		}
+	}
+}
+
+func TestRateLimiterDetachInFlight(t *testing.T) {
+	rl := NewRateLimiter(RateLimit{MaxInFlight: 1}, nil)
+	var release func()
+	handler := NewTokenAuthenticator().Verify(rl.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release = DetachInFlight(r.Context())
+	})))
+	request := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+NewTokenAuthenticator().Token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	// the detached work still holds the slot
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", code)
+	}
+	release()
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("expected the released slot to be reusable, got %d", code)
+	}
+}
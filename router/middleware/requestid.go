@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/aperture147/mediaproxy/logging"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	RequestInfoKey  = "requestInfo"
+
+	// Longer ids sent by the clients are replaced
+	MaxRequestIDLength = 128
+)
+
+// What the log lines of a request know about it, filled in by the middlewares
+type RequestInfo struct {
+	ID     string
+	Router string
+	Method string
+	Path   string
+	Start  time.Time
+
+	// Size of the uploaded file, set by FileExtractor
+	FileSize int
+}
+
+// Only printable ascii without quotes or spaces, the id ends up in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Give every request an id, the one sent in X-Request-ID is kept when it's sane
+type RequestLogger struct {
+	// Name of the router, on every log line of its requests
+	Router string
+}
+
+func NewRequestLogger(router string) RequestLogger {
+	return RequestLogger{router}
+}
+
+func (l RequestLogger) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		info := &RequestInfo{
+			ID:     id,
+			Router: l.Router,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Start:  time.Now(),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestInfoKey, info)))
+	})
+}
+
+// Returns nil when the request didn't go through a RequestLogger
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(RequestInfoKey).(*RequestInfo)
+	return info
+}
+
+/*
+Logger of the request: request id, router, caller identity, file size,
+time elapsed since the request came in and trace id, as far as they are known
+*/
+func Logger(ctx context.Context) *logging.Logger {
+	fields := logging.Fields{}
+	if info := RequestInfoFromContext(ctx); info != nil {
+		fields["request_id"] = info.ID
+		fields["router"] = info.Router
+		fields["method"] = info.Method
+		fields["path"] = info.Path
+		fields["duration_ms"] = time.Since(info.Start).Milliseconds()
+		if info.FileSize > 0 {
+			fields["file_size"] = info.FileSize
+		}
+	}
+	if p := PrincipalFromContext(ctx); p != nil {
+		fields["subject"] = p.Subject
+		if p.TenantID != "" {
+			fields["tenant_id"] = p.TenantID
+		}
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+	}
+	return logging.Default.With(fields)
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var info *RequestInfo
+	handler := NewRequestLogger("image").Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info = RequestInfoFromContext(r.Context())
+	}))
+
+	cases := []struct {
+		header string
+		kept   bool
+	}{
+		{"", false},
+		{"client-id-1", true},
+		{"bad id", false},
+		{strings.Repeat("a", MaxRequestIDLength+1), false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		if c.header != "" {
+			req.Header.Set(RequestIDHeader, c.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if info == nil || info.ID == "" || info.Router != "image" {
+			t.Fatalf("%q: unexpected request info %+v", c.header, info)
+		}
+		if (info.ID == c.header) != c.kept {
+			t.Errorf("%q: kept %v, got id %q", c.header, c.kept, info.ID)
+		}
+		if w.Header().Get(RequestIDHeader) != info.ID {
+			t.Errorf("%q: response header %q, expected %q", c.header, w.Header().Get(RequestIDHeader), info.ID)
+		}
+	}
+}
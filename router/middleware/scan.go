@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/scanner"
+	"github.com/aperture147/mediaproxy/util"
+	"net/http"
+)
+
+// Scan the original bytes of the uploaded file before anything is processed or stored
+type ScanVerifier struct {
+	Scanner scanner.Scanner
+	Field   string // the field extracted by FileExtractor
+}
+
+func NewScanVerifier(s scanner.Scanner, field string) ScanVerifier {
+	return ScanVerifier{s, field}
+}
+
+func (sv ScanVerifier) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sv.Scanner == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := sv.Scanner.Scan(r.Context().Value(sv.Field).(*[]byte))
+		if errors.Is(err, scanner.ErrInfected) {
+			util.WriteErrorResponse(w, util.ErrCodeFileInfected, fmt.Errorf("scan: %v", err))
+			return
+		}
+		if err != nil {
+			util.WriteErrorResponse(w, util.ErrCodeScanFailed, fmt.Errorf("scan: %v", err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -12,12 +12,13 @@ import (
 // Check the size of a request then check the size of a defined field of that request
 // and finally put the selected field to the request context
 type FileExtractor struct {
-	AllowedSize int64  // data size in byte
-	Field       string // the field which needs to be checked
+	AllowedSize    int64    // data size in byte
+	Field          string   // the field which needs to be checked
+	AllowedFormats []string // sniffed formats allowed for the field, see ValidateFormat. Empty allows anything
 }
 
-func NewFileExtractor(size int, field string) FileExtractor {
-	return FileExtractor{int64(size * 1024 * 1024), field}
+func NewFileExtractor(size int, field string, formats ...string) FileExtractor {
+	return FileExtractor{int64(size * 1024 * 1024), field, formats}
 }
 
 var ErrTooLarge = errors.New("too large")
@@ -25,16 +26,37 @@ var ErrTooLarge = errors.New("too large")
 // This function will try to verity the whole package size
 func (fe FileExtractor) Verify(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, fe.AllowedSize)
-		if err := r.ParseMultipartForm(fe.AllowedSize); err != nil {
+		allowedSize := fe.AllowedSize
+		if p := PrincipalFromContext(r.Context()); p != nil && p.MaxFileSize > 0 && p.MaxFileSize < allowedSize {
+			allowedSize = p.MaxFileSize
+		}
+
+		// a chunked body has no length, it's only stopped by the body limit
+		if r.ContentLength > allowedSize {
+			util.WriteErrorResponse(w, util.ErrCodeFileTooLarge, fmt.Errorf("request: %v", ErrTooLarge))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, allowedSize)
+		if err := r.ParseMultipartForm(allowedSize); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				util.WriteErrorResponse(w, util.ErrCodeFileTooLarge, fmt.Errorf("request: %v", ErrTooLarge))
+				return
+			}
 			util.WriteBadRequestResponse(w, err)
 			return
 		}
 
-		file, _, err := r.FormFile(fe.Field)
+		file, header, err := r.FormFile(fe.Field)
 
 		if err != nil {
-			util.WriteBadRequestResponse(w, fmt.Errorf("request: %v", ErrTooLarge))
+			util.WriteErrorResponse(w, util.ErrCodeFileMissing, fmt.Errorf("request: %s: %v", fe.Field, err))
+			return
+		}
+
+		// the body limit also counts the other fields, the file alone must fit too
+		if header.Size > allowedSize {
+			util.WriteErrorResponse(w, util.ErrCodeFileTooLarge, fmt.Errorf("request: %v", ErrTooLarge))
 			return
 		}
 
@@ -45,6 +67,16 @@ func (fe FileExtractor) Verify(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(context.Background(), fe.Field, &buffer)))
+		if len(fe.AllowedFormats) != 0 {
+			if _, err = ValidateFormat(buffer, header, fe.AllowedFormats); err != nil {
+				WriteUnsupportedFormatResponse(w, fmt.Errorf("format: %v", err))
+				return
+			}
+		}
+
+		if info := RequestInfoFromContext(r.Context()); info != nil {
+			info.FileSize = len(buffer)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), fe.Field, &buffer)))
 	})
 }
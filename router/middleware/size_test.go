@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aperture147/mediaproxy/util"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFileExtractorErrorCodes(t *testing.T) {
+	extractor := NewFileExtractor(1, "file")
+	handler := extractor.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		name    string
+		field   string
+		size    int
+		chunked bool
+		code    string
+	}{
+		{"too large", "file", 2 * util.MiB, false, util.ErrCodeFileTooLarge},
+		// no content length, the body limit stops it
+		{"too large chunked", "file", 2 * util.MiB, true, util.ErrCodeFileTooLarge},
+		{"missing", "other", 10, false, util.ErrCodeFileMissing},
+	}
+	for _, c := range cases {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		part, _ := mw.CreateFormFile(c.field, "upload.bin")
+		part.Write(make([]byte, c.size))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if c.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var response util.Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != c.code || w.Code != util.ErrorCatalog[c.code].Status {
+			t.Errorf("%s: expected %s, got %d %s", c.name, c.code, w.Code, response.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/aperture147/mediaproxy/tenant"
+	"github.com/aperture147/mediaproxy/util"
+	"net/http"
+	"strings"
+)
+
+// Scope granted for each router a tenant is allowed to use
+var TenantRouterScopes = map[string]string{
+	tenant.RouterImage: ScopeImageUpload,
+	tenant.RouterAudio: ScopeAudioUpload,
+}
+
+// Bearer api key authenticator backed by a tenant registry
+type TenantAuthenticator struct {
+	Registry tenant.Registry
+}
+
+func NewTenantAuthenticator(registry tenant.Registry) TenantAuthenticator {
+	return TenantAuthenticator{registry}
+}
+
+func TenantPrincipal(t *tenant.Tenant) *Principal {
+	scopes := make([]string, 0, len(t.Routers))
+	for _, router := range t.Routers {
+		if scope, ok := TenantRouterScopes[router]; ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &Principal{
+		Subject:       "tenant:" + t.ID,
+		Scopes:        scopes,
+		MaxFileSize:   t.MaxFileSize,
+		Presets:       t.Presets,
+		StoragePrefix: t.StoragePrefix(),
+		TenantID:      t.ID,
+		Tier:          t.Tier,
+		Storage:       t.Storage,
+	}
+}
+
+func (ta TenantAuthenticator) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			util.WriteForbiddenResponse(w, fmt.Errorf("tenant: %v", ErrNoToken))
+			return
+		}
+
+		rawAuth := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(rawAuth) != 2 || rawAuth[0] != "Bearer" {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("tenant: %v", ErrWrongToken))
+			return
+		}
+
+		t, err := ta.Registry.Lookup(rawAuth[1])
+		if err != nil {
+			util.WriteUnauthorizedResponse(w, fmt.Errorf("tenant: %v: %v", ErrWrongToken, err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), TenantPrincipal(t))))
+	})
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"github.com/aperture147/mediaproxy/tenant"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type staticRegistry map[string]*tenant.Tenant
+
+func (s staticRegistry) Lookup(apiKey string) (*tenant.Tenant, error) {
+	if t, ok := s[apiKey]; ok {
+		return t, nil
+	}
+	return nil, tenant.ErrUnknownAPIKey
+}
+
+func TestTenantAuthenticator(t *testing.T) {
+	auth := NewTenantAuthenticator(staticRegistry{
+		"acme-key": {ID: "acme", Routers: []string{tenant.RouterImage}, MaxFileSize: 2048},
+	})
+
+	var principal *Principal
+	handler := auth.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer acme-key")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.TenantID != "acme" || principal.MaxFileSize != 2048 {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+	if !principal.HasScope(ScopeImageUpload) || principal.HasScope(ScopeAudioUpload) {
+		t.Fatalf("unexpected scopes %v", principal.Scopes)
+	}
+	if principal.StoragePath("abc") != "tenants/acme/abc" {
+		t.Fatalf("unexpected storage path %s", principal.StoragePath("abc"))
+	}
+
+	req.Header.Set("Authorization", "Bearer other-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
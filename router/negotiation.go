@@ -0,0 +1,63 @@
+package router
+
+import (
+	"github.com/aperture147/mediaproxy/processor"
+	"strconv"
+	"strings"
+)
+
+// Variants a client has to explicitly ask for in its Accept header, ordered by preference.
+var NegotiableImageTypes = []string{processor.ImageTypeWebp}
+
+// Fallback variant for clients which don't accept the original format,
+// every browser understands jpeg
+const FallbackImageType = processor.ImageTypeJpeg
+
+var mimeImageTypes = map[string]string{
+	"image/jpeg": processor.ImageTypeJpeg,
+	"image/png":  processor.ImageTypePng,
+	"image/webp": processor.ImageTypeWebp,
+}
+
+// Check whether the Accept header explicitly lists the media type with a non zero q value.
+// Wildcards are ignored on purpose, almost every client sends */* and we don't want
+// to hand webp to a client just because it accepts anything.
+func acceptsExplicitly(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/*
+Pick the image type to serve for an original stored as originalType.
+The first negotiable variant listed in the Accept header wins. If none is
+listed the original is served, unless the original itself is a negotiable
+type the client didn't ask for, then the fallback type is served instead.
+*/
+func NegotiateImageType(accept, originalType string) string {
+	for _, imageType := range NegotiableImageTypes {
+		if acceptsExplicitly(accept, "image/"+imageType) {
+			return imageType
+		}
+	}
+	for _, imageType := range NegotiableImageTypes {
+		if imageType == originalType {
+			return FallbackImageType
+		}
+	}
+	return originalType
+}
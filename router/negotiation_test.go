@@ -0,0 +1,27 @@
+package router
+
+import (
+	"github.com/aperture147/mediaproxy/processor"
+	"testing"
+)
+
+func TestNegotiateImageType(t *testing.T) {
+	cases := []struct {
+		accept   string
+		original string
+		expected string
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", processor.ImageTypeJpeg, processor.ImageTypeWebp},
+		{"image/webp;q=0.5", processor.ImageTypePng, processor.ImageTypeWebp},
+		{"image/webp;q=0", processor.ImageTypePng, processor.ImageTypePng},
+		{"image/*,*/*", processor.ImageTypeJpeg, processor.ImageTypeJpeg},
+		{"", processor.ImageTypePng, processor.ImageTypePng},
+		{"", processor.ImageTypeWebp, processor.ImageTypeJpeg},
+		{"image/webp", processor.ImageTypeWebp, processor.ImageTypeWebp},
+	}
+	for _, c := range cases {
+		if result := NegotiateImageType(c.accept, c.original); result != c.expected {
+			t.Errorf("accept %q, original %s: expected %s, got %s", c.accept, c.original, c.expected, result)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/util"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+var ErrPolicyNotAllowed = errors.New("policy exceeds the caller permissions")
+
+type PolicyRouterSetting struct {
+	Path   string // router path
+	Secret []byte // secret shared with the PolicyAuthenticator of the upload routers
+
+	// Authenticator of the backends minting policies, nil falls back to the static token authenticator
+	Authenticator middleware.Authenticator
+}
+
+type PolicyRequest struct {
+	Router      string `json:"router"`
+	Preset      string `json:"preset"`
+	MaxFileSize int64  `json:"max_file_size"`
+	ExpiresIn   int64  `json:"expires_in"` // in seconds
+}
+
+type PolicyResponse struct {
+	Policy    string `json:"policy"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+/*
+Build a policy which never grants more than the caller has: same router scopes,
+presets, size limit and storage prefix.
+A tenant specific storage backend is only flagged by the policy, the PolicyAuthenticator
+of the upload routers resolves it from the tenant id with its TenantStorage lookup.
+*/
+func NewUploadPolicy(p *middleware.Principal, req PolicyRequest) (*middleware.UploadPolicy, error) {
+	if !p.HasScope(middleware.TenantRouterScopes[req.Router]) {
+		return nil, fmt.Errorf("%w: router %s", ErrPolicyNotAllowed, req.Router)
+	}
+	if len(p.Presets) != 0 && (req.Preset == "" || !p.AllowsPreset(req.Preset)) {
+		return nil, fmt.Errorf("%w: preset %q", ErrPolicyNotAllowed, req.Preset)
+	}
+
+	if p.Storage != nil && p.TenantID == "" {
+		// the backend couldn't be found back from the policy
+		return nil, fmt.Errorf("%w: storage of %s", ErrPolicyNotAllowed, p.Subject)
+	}
+
+	maxFileSize := req.MaxFileSize
+	if p.MaxFileSize > 0 && (maxFileSize <= 0 || maxFileSize > p.MaxFileSize) {
+		maxFileSize = p.MaxFileSize
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = middleware.DefaultPolicyTTL
+	}
+	if ttl > middleware.MaxPolicyTTL {
+		ttl = middleware.MaxPolicyTTL
+	}
+
+	return &middleware.UploadPolicy{
+		Subject:       p.Subject,
+		Router:        req.Router,
+		Preset:        req.Preset,
+		MaxFileSize:   maxFileSize,
+		StoragePrefix: p.StoragePrefix,
+		TenantID:      p.TenantID,
+		Tier:          p.Tier,
+		TenantStorage: p.TenantID != "" && p.Storage != nil,
+		ExpiresAt:     time.Now().Add(ttl).Unix(),
+	}, nil
+}
+
+// Endpoint minting upload policies for authenticated backends
+func NewPolicyRouter(setting PolicyRouterSetting) *mux.Router {
+	auth := Setting{Authenticator: setting.Authenticator}.authenticator()
+
+	r := mux.NewRouter()
+	r.Use(middleware.NewRequestLogger("policy").Handle, auth.Verify)
+	r.HandleFunc(setting.Path, func(w http.ResponseWriter, r *http.Request) {
+		var req PolicyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			util.WriteBadRequestResponse(w, fmt.Errorf("policy: %v", err))
+			return
+		}
+
+		policy, err := NewUploadPolicy(middleware.PrincipalFromContext(r.Context()), req)
+		if err != nil {
+			util.WriteForbiddenResponse(w, fmt.Errorf("policy: %v", err))
+			return
+		}
+		signed, err := middleware.SignPolicy(setting.Secret, *policy)
+		if err != nil {
+			util.WriteBadRequestResponse(w, fmt.Errorf("policy: %v", err))
+			return
+		}
+		util.WriteOkResponse(w, PolicyResponse{
+			Policy:    signed,
+			ExpiresAt: policy.ExpiresAt,
+		})
+	}).Methods(http.MethodPost)
+	return r
+}
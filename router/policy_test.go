@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tenant"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyUploadTenantStorage(t *testing.T) {
+	routerDir, tenantDir := t.TempDir(), t.TempDir()
+	registryPath := filepath.Join(t.TempDir(), "tenants.json")
+	config := fmt.Sprintf(`{"tenants": [{"id": "acme", "api_keys": ["key"], "routers": ["image"],
+		"storage": {"backend": "fs", "path": %q}}]}`, tenantDir)
+	if err := ioutil.WriteFile(registryPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := tenant.NewFileRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := registry.Lookup("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("secret")
+	policy, err := NewUploadPolicy(middleware.TenantPrincipal(acme), PolicyRequest{Router: tenant.RouterImage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := middleware.SignPolicy(secret, *policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRouter := func(lookup func(string) storage.Storage) http.Handler {
+		auth := middleware.NewPolicyAuthenticator(secret, middleware.NewTokenAuthenticator())
+		auth.TenantStorage = lookup
+		return NewImageRouter(ImageRouterSetting{
+			Setting: Setting{
+				Context:       context.Background(),
+				Storage:       storage.NewFileSystemStorage(routerDir),
+				Path:          "/image/upload",
+				Authenticator: auth,
+			},
+			MaxFileSize:     10,
+			MaxImageDimSize: 1024,
+		})
+	}
+	uploadPath := "/image/upload?policy=" + url.QueryEscape(signed)
+
+	w := httptest.NewRecorder()
+	newRouter(registry.Storage).ServeHTTP(w, multipartUpload(t, uploadPath, ImageFileField, "test.png", "image/png", testPng(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data PathResponse `json:"data"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(acme.StoragePrefix(), response.Data.Hash)
+	if _, err = os.Stat(filepath.Join(tenantDir, fileName)); err != nil {
+		t.Fatalf("upload not in the tenant storage: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(routerDir, fileName)); !os.IsNotExist(err) {
+		t.Fatalf("upload leaked to the router storage: %v", err)
+	}
+
+	// without the lookup the upload is refused rather than saved to the router storage
+	w = httptest.NewRecorder()
+	newRouter(nil).ServeHTTP(w, multipartUpload(t, uploadPath, ImageFileField, "test.png", "image/png", testPng(t)))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
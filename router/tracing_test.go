@@ -0,0 +1,71 @@
+package router
+
+import (
+	"context"
+	"github.com/aperture147/mediaproxy/router/middleware"
+	"github.com/aperture147/mediaproxy/storage"
+	"github.com/aperture147/mediaproxy/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestImageRouterTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := tracing.Setup(context.Background(), tracing.Options{SpanExporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	r := NewImageRouter(ImageRouterSetting{
+		Setting: Setting{
+			Context: context.Background(),
+			Storage: storage.NewFileSystemStorage(t.TempDir()),
+			Path:    "/image/upload",
+			Authenticator: staticAuthenticator{&middleware.Principal{
+				Subject: "tester",
+				Scopes:  []string{middleware.ScopeImageUpload},
+			}},
+		},
+		MaxFileSize:     10,
+		MaxImageDimSize: 1024,
+	})
+	req := multipartUpload(t, "/image/upload", ImageFileField, "test.png", "image/png", testPng(t))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s is not part of the incoming trace", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	server, ok := spans["POST /image/upload"]
+	if !ok {
+		t.Fatal("missing server span")
+	}
+	for _, name := range []string{
+		"staticAuthenticator.Verify",
+		"FileExtractor.Verify",
+		"ImageDecoder.Decode",
+		"queue.wait",
+		"image.transform",
+		"Storage.Save",
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("missing %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%s span is not a child of the server span", name)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInfected   = errors.New("file is infected")
+	ErrScanFailed = errors.New("cannot scan file")
+)
+
+// Returned by Scan when the scanner found something, errors.Is(err, ErrInfected) holds
+type InfectedError struct {
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrInfected, e.Signature)
+}
+
+func (e *InfectedError) Unwrap() error {
+	return ErrInfected
+}
+
+type Scanner interface {
+	// Scan returns nil if the file is clean, an InfectedError if it's not
+	// and an error wrapping ErrScanFailed if the scan couldn't be done
+	Scan(buf *[]byte) error
+}
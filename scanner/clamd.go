@@ -0,0 +1,129 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultClamdTimeout = 30 * time.Second
+	// clamd StreamMaxLength defaults to 25M, chunks must stay way below that
+	DefaultClamdChunkSize = 64 * 1024
+)
+
+/*
+Scanner talking to a clamd compatible daemon with the INSTREAM command,
+over tcp (network "tcp", address "host:port") or a unix socket (network "unix").
+Check the clamd man page for the protocol: https://linux.die.net/man/8/clamd
+*/
+type ClamdScanner struct {
+	Network string
+	Address string
+
+	// Deadline for the whole scan, dial included, 0 uses DefaultClamdTimeout
+	Timeout time.Duration
+
+	// Size of the chunks streamed to the daemon, 0 uses DefaultClamdChunkSize
+	ChunkSize int
+
+	// When the daemon can't be reached or fails, let the file through instead of rejecting it
+	FailOpen bool
+}
+
+func NewClamdScanner(network, address string, failOpen bool) Scanner {
+	return ClamdScanner{
+		Network:   network,
+		Address:   address,
+		Timeout:   DefaultClamdTimeout,
+		ChunkSize: DefaultClamdChunkSize,
+		FailOpen:  failOpen,
+	}
+}
+
+func (s ClamdScanner) Scan(buf *[]byte) error {
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultClamdTimeout
+	}
+	if s.ChunkSize <= 0 {
+		s.ChunkSize = DefaultClamdChunkSize
+	}
+	err := s.scan(*buf)
+	if err == nil {
+		return nil
+	}
+	if _, infected := err.(*InfectedError); infected {
+		return err
+	}
+	err = fmt.Errorf("clamd: %w: %v", ErrScanFailed, err)
+	if s.FailOpen {
+		logging.Warn("scan failed, failing open", err, nil)
+		return nil
+	}
+	return err
+}
+
+func (s ClamdScanner) scan(data []byte) error {
+	conn, err := net.DialTimeout(s.Network, s.Address, s.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return err
+	}
+
+	// z prefix: null terminated command and reply
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	// each chunk is prefixed by its length as a 4 bytes big endian integer
+	size := make([]byte, 4)
+	for offset := 0; offset < len(data); offset += s.ChunkSize {
+		end := offset + s.ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(size, uint32(end-offset))
+		if _, err = conn.Write(size); err != nil {
+			return err
+		}
+		if _, err = conn.Write(data[offset:end]); err != nil {
+			return err
+		}
+	}
+	// zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00")))
+}
+
+// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) error {
+	reply = strings.TrimSpace(reply)
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+		return &InfectedError{Signature: signature}
+	case strings.HasSuffix(reply, ": OK"):
+		return nil
+	default:
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+}
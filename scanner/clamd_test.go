@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// Minimal clamd speaking INSTREAM, flags anything containing the EICAR test string
+func startFakeClamd(t *testing.T, network, address string) net.Listener {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn)
+		}
+	}()
+	return listener
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND ERROR\x00"))
+		return
+	}
+
+	stream := new(bytes.Buffer)
+	size := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, size); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(size)
+		if length == 0 {
+			break
+		}
+		if _, err = io.CopyN(stream, reader, int64(length)); err != nil {
+			return
+		}
+	}
+
+	if bytes.Contains(stream.Bytes(), eicar) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamdScanner(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	for _, network := range []string{"tcp", "unix"} {
+		address := "127.0.0.1:0"
+		if network == "unix" {
+			address = socket
+		}
+		listener := startFakeClamd(t, network, address)
+
+		s := ClamdScanner{
+			Network:   network,
+			Address:   listener.Addr().String(),
+			Timeout:   time.Second,
+			ChunkSize: 7, // make sure the payload spans several chunks
+		}
+
+		clean := bytes.Repeat([]byte("clean audio data "), 100)
+		if err := s.Scan(&clean); err != nil {
+			t.Fatalf("%s: clean file rejected: %v", network, err)
+		}
+
+		// zero timeout and chunk size use the defaults
+		if err := (ClamdScanner{Network: network, Address: listener.Addr().String()}).Scan(&clean); err != nil {
+			t.Fatalf("%s: clean file rejected by the zero scanner: %v", network, err)
+		}
+
+		infected := append(append([]byte("prefix"), eicar...), []byte("suffix")...)
+		err := s.Scan(&infected)
+		var infectedErr *InfectedError
+		if !errors.Is(err, ErrInfected) || !errors.As(err, &infectedErr) || infectedErr.Signature != "Eicar-Test-Signature" {
+			t.Fatalf("%s: expected an infected error, got %v", network, err)
+		}
+		listener.Close()
+	}
+}
+
+func TestClamdScannerFailure(t *testing.T) {
+	// grab a free port then release it so nothing listens there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	data := []byte("whatever")
+	closed := ClamdScanner{Network: "tcp", Address: address, Timeout: time.Second, ChunkSize: DefaultClamdChunkSize}
+	if err = closed.Scan(&data); !errors.Is(err, ErrScanFailed) {
+		t.Fatalf("expected the scan to fail closed, got %v", err)
+	}
+
+	open := closed
+	open.FailOpen = true
+	if err = open.Scan(&data); err != nil {
+		t.Fatalf("expected the scan to fail open, got %v", err)
+	}
+}
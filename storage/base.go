@@ -1,5 +1,38 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// Prefix of the files written by Probe
+const ProbePrefix = ".probe-"
+
 type Storage interface {
 	Save(fileName, contentType string, buf *[]byte) (string, error)
+
+	// Load returns the content of a file previously saved with Save,
+	// ErrNotFound is returned if there is no such file
+	Load(fileName string) (*[]byte, error)
+
+	// Delete removes a file previously saved with Save,
+	// ErrNotFound may be returned if there is no such file
+	Delete(fileName string) error
+}
+
+// Check the storage is writable by saving then deleting a small file
+func Probe(s Storage) error {
+	fileName := ProbePrefix + strconv.FormatInt(time.Now().UnixNano(), 36)
+	buf := []byte("ok")
+	if _, err := s.Save(fileName, "text/plain", &buf); err != nil {
+		return fmt.Errorf("probe save: %w", err)
+	}
+	if err := s.Delete(fileName); err != nil {
+		return fmt.Errorf("probe delete: %w", err)
+	}
+	return nil
 }
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 )
 
@@ -22,6 +24,30 @@ saving file to
 */
 func (s FileSystemStorage) Save(fileName, _ string, buf *[]byte) (string, error) {
 	fullPath := path.Join(s.Path, fileName)
+	// prefixed names, e.g. tenants/{id}/{hash}, live in sub directories
+	if err := os.MkdirAll(path.Dir(fullPath), 0755); err != nil {
+		return fullPath, err
+	}
 	err := ioutil.WriteFile(fullPath, *buf, 0755)
 	return fullPath, err
 }
+
+// fileName here is the same name passed to Save, not the returned full path
+func (s FileSystemStorage) Load(fileName string) (*[]byte, error) {
+	buf, err := ioutil.ReadFile(path.Join(s.Path, fileName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("fs: %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func (s FileSystemStorage) Delete(fileName string) error {
+	err := os.Remove(path.Join(s.Path, fileName))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("fs: %w", ErrNotFound)
+	}
+	return err
+}
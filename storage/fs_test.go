@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFileSystemStorageSubDirectory(t *testing.T) {
+	s := NewFileSystemStorage(t.TempDir())
+	buf := []byte("data")
+	if _, err := s.Save("tenants/acme/abc", "text/plain", &buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Load("tenants/acme/abc")
+	if err != nil || !bytes.Equal(*loaded, buf) {
+		t.Fatalf("unexpected load %v %v", loaded, err)
+	}
+	if err = s.Delete("tenants/acme/abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Load("tenants/acme/abc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
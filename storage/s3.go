@@ -2,8 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"path"
 )
@@ -11,17 +14,19 @@ import (
 var AllUserAccess = aws.String("uri=http://acs.amazonaws.com/groups/global/AllUsers")
 
 type S3Storage struct {
-	Uploader *s3manager.Uploader // thread-safe uploader
-	Bucket   *string             // selected bucket
-	Path     *string             // path inside the bucket
+	Uploader   *s3manager.Uploader   // thread-safe uploader
+	Downloader *s3manager.Downloader // thread-safe downloader
+	Bucket     *string               // selected bucket
+	Path       *string               // path inside the bucket
 }
 
 func NewS3Storage(bucket, path string) Storage {
 	sess := session.Must(session.NewSession())
 	return S3Storage{
-		Uploader: s3manager.NewUploader(sess),
-		Bucket:   &bucket,
-		Path:     &path,
+		Uploader:   s3manager.NewUploader(sess),
+		Downloader: s3manager.NewDownloader(sess),
+		Bucket:     &bucket,
+		Path:       &path,
 	}
 }
 
@@ -41,3 +46,29 @@ func (s S3Storage) Save(fileName, contentType string, buf *[]byte) (string, erro
 	})
 	return *key, err
 }
+
+// fileName here is the same name passed to Save, not the returned key
+func (s S3Storage) Load(fileName string) (*[]byte, error) {
+	buf := aws.NewWriteAtBuffer([]byte{})
+	_, err := s.Downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: s.Bucket,
+		Key:    aws.String(path.Join(*s.Path, fileName)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("s3: %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := buf.Bytes()
+	return &result, nil
+}
+
+// Deleting a missing key succeeds on s3, ErrNotFound is never returned
+func (s S3Storage) Delete(fileName string) error {
+	_, err := s.Uploader.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: s.Bucket,
+		Key:    aws.String(path.Join(*s.Path, fileName)),
+	})
+	return err
+}
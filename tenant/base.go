@@ -0,0 +1,59 @@
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/storage"
+	"path"
+	"regexp"
+)
+
+var (
+	ErrUnknownAPIKey = errors.New("unknown api key")
+	ErrInvalidID     = errors.New("tenant id must be made of letters, digits, '_' and '-'")
+)
+
+// The id is a path segment of the tenant files, it can't be empty nor hold '/' or '.'
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateID returns ErrInvalidID when id can't be used as a tenant id, registries must check every id
+func ValidateID(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return nil
+}
+
+const (
+	RouterImage = "image"
+	RouterAudio = "audio"
+)
+
+type Tenant struct {
+	ID string
+
+	// Routers the tenant may upload to, see the Router constants
+	Routers []string
+
+	// Max upload size in bytes, 0 keeps the router limit
+	MaxFileSize int64
+
+	// Presets the tenant may use, empty allows every preset
+	Presets []string
+
+	// Rate limit tier
+	Tier string
+
+	// Backend the tenant files are saved to, nil keeps the router storage
+	Storage storage.Storage
+}
+
+// Every tenant file lives under tenants/{id}, the id was checked by ValidateID so it can't escape it
+func (t *Tenant) StoragePrefix() string {
+	return path.Join("tenants", t.ID)
+}
+
+type Registry interface {
+	// Lookup returns the tenant owning the api key, ErrUnknownAPIKey if there is none
+	Lookup(apiKey string) (*Tenant, error)
+}
@@ -0,0 +1,167 @@
+package tenant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aperture147/mediaproxy/storage"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	BackendFileSystem = "fs"
+	BackendS3         = "s3"
+)
+
+const hashedKeyPrefix = "sha256:"
+
+var (
+	ErrDuplicatedAPIKey = errors.New("api key used by more than one tenant")
+	ErrDuplicatedID     = errors.New("tenant id used more than once")
+	ErrUnknownBackend   = errors.New("unknown storage backend")
+)
+
+type storageConfig struct {
+	Backend string `json:"backend"` // fs, s3 or empty to keep the router storage
+	Bucket  string `json:"bucket"`  // s3 only
+	Path    string `json:"path"`
+}
+
+type tenantConfig struct {
+	ID string `json:"id"`
+
+	// Raw api keys, or their sha256 hex digest prefixed by "sha256:"
+	// so the registry file doesn't have to hold secrets
+	APIKeys []string `json:"api_keys"`
+
+	Routers     []string      `json:"routers"`
+	MaxFileSize int64         `json:"max_file_size"`
+	Presets     []string      `json:"presets"`
+	Tier        string        `json:"tier"`
+	Storage     storageConfig `json:"storage"`
+}
+
+/*
+Registry read from a json file:
+
+	{"tenants": [{
+		"id": "acme",
+		"api_keys": ["sha256:9f86d081884c7d65..."],
+		"routers": ["image"],
+		"max_file_size": 5242880,
+		"presets": ["avatar"],
+		"tier": "premium",
+		"storage": {"backend": "s3", "bucket": "acme-media", "path": "/uploads"}
+	}]}
+*/
+type FileRegistry struct {
+	Path string
+
+	mutex   sync.RWMutex
+	tenants map[string]*Tenant // indexed by the sha256 of the api keys
+	byID    map[string]*Tenant
+}
+
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{Path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func hashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func newStorage(config storageConfig) (storage.Storage, error) {
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case BackendFileSystem:
+		return storage.NewFileSystemStorage(config.Path), nil
+	case BackendS3:
+		return storage.NewS3Storage(config.Bucket, config.Path), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, config.Backend)
+}
+
+// Read the file again, the registry is left untouched if the file is invalid
+func (r *FileRegistry) Reload() error {
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return fmt.Errorf("tenant: %v", err)
+	}
+	var config struct {
+		Tenants []tenantConfig `json:"tenants"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("tenant: %v", err)
+	}
+
+	tenants := make(map[string]*Tenant)
+	ids := make(map[string]*Tenant, len(config.Tenants))
+	for _, c := range config.Tenants {
+		if err = ValidateID(c.ID); err != nil {
+			return fmt.Errorf("tenant: %w", err)
+		}
+		if _, ok := ids[c.ID]; ok {
+			return fmt.Errorf("tenant %s: %w", c.ID, ErrDuplicatedID)
+		}
+		s, err := newStorage(c.Storage)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", c.ID, err)
+		}
+		t := &Tenant{
+			ID:          c.ID,
+			Routers:     c.Routers,
+			MaxFileSize: c.MaxFileSize,
+			Presets:     c.Presets,
+			Tier:        c.Tier,
+			Storage:     s,
+		}
+		ids[c.ID] = t
+		for _, key := range c.APIKeys {
+			hash := hashAPIKey(key)
+			if strings.HasPrefix(key, hashedKeyPrefix) {
+				hash = strings.ToLower(strings.TrimPrefix(key, hashedKeyPrefix))
+			}
+			if _, ok := tenants[hash]; ok {
+				return fmt.Errorf("tenant %s: %w", c.ID, ErrDuplicatedAPIKey)
+			}
+			tenants[hash] = t
+		}
+	}
+
+	r.mutex.Lock()
+	r.tenants = tenants
+	r.byID = ids
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *FileRegistry) Lookup(apiKey string) (*Tenant, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	t, ok := r.tenants[hashAPIKey(apiKey)]
+	if !ok {
+		return nil, ErrUnknownAPIKey
+	}
+	return t, nil
+}
+
+// Backend of the tenant, nil when the tenant is unknown or keeps the router storage.
+// Hand it to the routers needing the storage of a tenant they only know the id of
+func (r *FileRegistry) Storage(tenantID string) storage.Storage {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if t, ok := r.byID[tenantID]; ok {
+		return t.Storage
+	}
+	return nil
+}
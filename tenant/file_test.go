@@ -0,0 +1,73 @@
+package tenant
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeRegistry(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileRegistry(t *testing.T) {
+	// sha256("hashed-key")
+	path := writeRegistry(t, `{"tenants": [
+		{"id": "acme", "api_keys": ["plain-key"], "routers": ["image"], "max_file_size": 1024, "presets": ["avatar"],
+		 "storage": {"backend": "fs", "path": "/tmp"}},
+		{"id": "globex", "api_keys": ["sha256:a4ae87b73fa5645e6aee415a6f72be4dcbd99d057a7b40cb1b867c181d179260"], "routers": ["image", "audio"]}
+	]}`)
+	registry, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme, err := registry.Lookup("plain-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acme.ID != "acme" || acme.MaxFileSize != 1024 || acme.Storage == nil || acme.StoragePrefix() != "tenants/acme" {
+		t.Fatalf("unexpected tenant %+v", acme)
+	}
+	if registry.Storage("acme") != acme.Storage || registry.Storage("globex") != nil || registry.Storage("nope") != nil {
+		t.Fatal("unexpected tenant storages")
+	}
+
+	globex, err := registry.Lookup("hashed-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if globex.ID != "globex" || globex.Storage != nil {
+		t.Fatalf("unexpected tenant %+v", globex)
+	}
+
+	if _, err = registry.Lookup("nope"); !errors.Is(err, ErrUnknownAPIKey) {
+		t.Fatalf("expected unknown api key, got %v", err)
+	}
+}
+
+func TestFileRegistryInvalid(t *testing.T) {
+	duplicated := writeRegistry(t, `{"tenants": [{"id": "a", "api_keys": ["k"]}, {"id": "b", "api_keys": ["k"]}]}`)
+	if _, err := NewFileRegistry(duplicated); !errors.Is(err, ErrDuplicatedAPIKey) {
+		t.Fatalf("expected duplicated api key, got %v", err)
+	}
+	for _, id := range []string{"", "..", "a/b", "a.b"} {
+		invalid := writeRegistry(t, `{"tenants": [{"id": "`+id+`", "api_keys": ["k"]}]}`)
+		if _, err := NewFileRegistry(invalid); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("expected invalid id for %q, got %v", id, err)
+		}
+	}
+	duplicatedID := writeRegistry(t, `{"tenants": [{"id": "a", "api_keys": ["k"]}, {"id": "a", "api_keys": ["l"]}]}`)
+	if _, err := NewFileRegistry(duplicatedID); !errors.Is(err, ErrDuplicatedID) {
+		t.Fatalf("expected duplicated id, got %v", err)
+	}
+	backend := writeRegistry(t, `{"tenants": [{"id": "a", "api_keys": ["k"], "storage": {"backend": "ftp"}}]}`)
+	if _, err := NewFileRegistry(backend); !errors.Is(err, ErrUnknownBackend) {
+		t.Fatalf("expected unknown backend, got %v", err)
+	}
+}
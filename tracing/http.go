@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/aperture147/mediaproxy/httputil"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"reflect"
+)
+
+const middlewareSpanKey = "tracingMiddlewareSpan"
+
+/*
+Middleware starting the server span of the request, as a child of the W3C trace
+context of the caller when there is one. Use it on the root router, before the
+other middlewares.
+*/
+func Extract(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx, span := Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, r)...),
+		)
+		defer span.End()
+
+		sw := httputil.NewStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(sw.Status())...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(sw.Status()))
+	})
+}
+
+// Span of a middleware, along with the span it was started under
+type middlewareSpan struct {
+	trace.Span
+	parent trace.Span
+	passed bool
+}
+
+/*
+Trace a middleware: the span starts with the middleware and ends once it calls
+the next handler, so it only covers the middleware itself. A middleware which
+doesn't call the next handler rejected the request, its span is an error.
+*/
+func Middleware(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span, ok := r.Context().Value(middlewareSpanKey).(*middlewareSpan)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			span.passed = true
+			span.End()
+			// the next handlers are siblings of the middleware span, the values set by the middleware are kept
+			ctx := context.WithValue(trace.ContextWithSpan(r.Context(), span.parent), middlewareSpanKey, nil)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent := trace.SpanFromContext(r.Context())
+			ctx, s := Start(r.Context(), name)
+			span := &middlewareSpan{Span: s, parent: parent}
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(ctx, middlewareSpanKey, span)))
+			if !span.passed {
+				span.SetStatus(codes.Error, "rejected")
+				span.End()
+			}
+		})
+	}
+}
+
+// Name of a method for span names, e.g. TokenAuthenticator.Verify
+func MethodName(v interface{}, method string) string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return fmt.Sprintf("%s.%s", t.Name(), method)
+}
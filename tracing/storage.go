@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"github.com/aperture147/mediaproxy/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+Storage tracing the calls of the wrapped backend. The storage interface has no
+context, so the spans are children of the context the storage was wrapped with.
+*/
+type Storage struct {
+	storage.Storage
+	Context context.Context
+}
+
+// Wrap s with ctx, the context of an already traced storage is replaced
+func InstrumentStorage(ctx context.Context, s storage.Storage) storage.Storage {
+	switch traced := s.(type) {
+	case nil:
+		return nil
+	case Storage:
+		s = traced.Storage
+	}
+	return Storage{Storage: s, Context: ctx}
+}
+
+func (s Storage) Save(fileName, contentType string, buf *[]byte) (string, error) {
+	_, span := Start(s.Context, "Storage.Save")
+	span.SetAttributes(
+		attribute.String("storage.file", fileName),
+		attribute.String("storage.content_type", contentType),
+		attribute.Int("storage.size", len(*buf)),
+	)
+	path, err := s.Storage.Save(fileName, contentType, buf)
+	End(span, err)
+	return path, err
+}
+
+func (s Storage) Load(fileName string) (*[]byte, error) {
+	_, span := Start(s.Context, "Storage.Load")
+	span.SetAttributes(attribute.String("storage.file", fileName))
+	buf, err := s.Storage.Load(fileName)
+	End(span, err)
+	return buf, err
+}
+
+func (s Storage) Delete(fileName string) error {
+	_, span := Start(s.Context, "Storage.Delete")
+	span.SetAttributes(attribute.String("storage.file", fileName))
+	err := s.Storage.Delete(fileName)
+	End(span, err)
+	return err
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strconv"
+)
+
+// Name of the tracer of every mediaproxy span
+const TracerName = "github.com/aperture147/mediaproxy"
+
+const DefaultServiceName = "mediaproxy"
+
+// Exporters picked by Options.Exporter
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOtlp   = "otlp"
+)
+
+var ErrUnknownExporter = errors.New("unknown trace exporter")
+
+// W3C trace context and baggage, extracted from the incoming requests whatever the global propagator is
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+type Options struct {
+	// One of the Exporter constants, empty disables tracing
+	Exporter string
+
+	// Host and port of the otlp http receiver, empty uses the exporter default (localhost:4318)
+	Endpoint string
+	// Talk plain http to the otlp receiver
+	Insecure bool
+
+	// Empty uses DefaultServiceName
+	ServiceName string
+
+	// Share of the new traces sampled, traces started upstream follow their parent.
+	// 0 samples everything
+	SampleRatio float64
+
+	// Export to this exporter instead, synchronously, e.g. a tracetest.InMemoryExporter
+	SpanExporter sdktrace.SpanExporter
+}
+
+/*
+Options read from the environment:
+TRACE_EXPORTER, OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_INSECURE,
+OTEL_SERVICE_NAME and TRACE_SAMPLE_RATIO
+*/
+func OptionsFromEnv() Options {
+	insecure, _ := strconv.ParseBool(os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"))
+	ratio, _ := strconv.ParseFloat(os.Getenv("TRACE_SAMPLE_RATIO"), 64)
+	return Options{
+		Exporter:    os.Getenv("TRACE_EXPORTER"),
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		Insecure:    insecure,
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		SampleRatio: ratio,
+	}
+}
+
+func newExporter(ctx context.Context, options Options) (sdktrace.SpanExporter, error) {
+	switch options.Exporter {
+	case ExporterStdout:
+		return stdouttrace.New()
+	case ExporterOtlp:
+		var opts []otlptracehttp.Option
+		if options.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(options.Endpoint))
+		}
+		if options.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExporter, options.Exporter)
+	}
+}
+
+/*
+Build the tracer provider of the options, nil when tracing is disabled.
+Shut the provider down before exiting, the spans are exported in batches.
+*/
+func NewProvider(ctx context.Context, options Options) (*sdktrace.TracerProvider, error) {
+	serviceName := options.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if options.SampleRatio > 0 && options.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(options.SampleRatio)
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	}
+
+	switch {
+	case options.SpanExporter != nil:
+		opts = append(opts, sdktrace.WithSyncer(options.SpanExporter))
+	case options.Exporter == "" || options.Exporter == ExporterNone:
+		return nil, nil
+	default:
+		exporter, err := newExporter(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+// Install the provider of the options globally, the returned function flushes and stops it
+func Setup(ctx context.Context, options Options) (func(context.Context) error, error) {
+	provider, err := NewProvider(ctx, options)
+	if err != nil || provider == nil {
+		return func(context.Context) error { return nil }, err
+	}
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(Propagator)
+	return provider.Shutdown, nil
+}
+
+// Tracer of the global provider, spans are dropped until Setup is called
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End the span, recording err
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/aperture147/mediaproxy/storage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+)
+
+func setupTest(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := Setup(context.Background(), Options{SpanExporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(context.Background()) })
+	return exporter
+}
+
+func spanByName(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span in %d spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+type rejecting struct{}
+
+func (rejecting) Verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestExtractAndMiddleware(t *testing.T) {
+	exporter := setupTest(t)
+	var handlerSpan trace.SpanContext
+	name := MethodName(&rejecting{}, "Verify")
+	handler := Extract(Middleware(name, rejecting{}.Verify)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	req.Header.Set("Authorization", "Bearer token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	server := spanByName(t, spans, "POST /upload")
+	if server.SpanContext.TraceID().String() != testTraceID || !server.Parent.IsRemote() {
+		t.Fatalf("server span not under the incoming trace: %v", server.SpanContext.TraceID())
+	}
+	verify := spanByName(t, spans, "rejecting.Verify")
+	if verify.Parent.SpanID() != server.SpanContext.SpanID() || verify.Status.Code == codes.Error {
+		t.Fatalf("unexpected middleware span %+v", verify)
+	}
+	// the handler runs under the server span, not under the ended middleware span
+	if handlerSpan.SpanID() != server.SpanContext.SpanID() {
+		t.Fatal("handler is not a sibling of the middleware span")
+	}
+
+	exporter.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+	spans = exporter.GetSpans()
+	if verify = spanByName(t, spans, "rejecting.Verify"); verify.Status.Code != codes.Error {
+		t.Fatal("a rejected request should fail the middleware span")
+	}
+	if server := spanByName(t, spans, "POST /upload"); server.Status.Code != codes.Error {
+		t.Fatal("a 401 should fail the server span")
+	}
+}
+
+type memoryStorage struct{}
+
+func (memoryStorage) Save(fileName, contentType string, buf *[]byte) (string, error) {
+	return fileName, nil
+}
+
+func (memoryStorage) Load(fileName string) (*[]byte, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (memoryStorage) Delete(fileName string) error {
+	return nil
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	exporter := setupTest(t)
+	ctx, parent := Start(context.Background(), "parent")
+	s := InstrumentStorage(ctx, InstrumentStorage(context.Background(), memoryStorage{}))
+	if _, ok := s.(Storage).Storage.(memoryStorage); !ok {
+		t.Fatal("storage traced twice")
+	}
+
+	buf := []byte("data")
+	s.Save("file", "text/plain", &buf)
+	if _, err := s.Load("file"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if save := spanByName(t, spans, "Storage.Save"); save.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("save span is not a child of the storage context")
+	}
+	if load := spanByName(t, spans, "Storage.Load"); load.Status.Code != codes.Error {
+		t.Fatal("load error not recorded")
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	provider, err := NewProvider(context.Background(), Options{})
+	if err != nil || provider != nil {
+		t.Fatalf("expected tracing to be disabled, got %v %v", provider, err)
+	}
+	if _, err = NewProvider(context.Background(), Options{Exporter: "zipkin"}); !errors.Is(err, ErrUnknownExporter) {
+		t.Fatalf("expected ErrUnknownExporter, got %v", err)
+	}
+	provider, err = NewProvider(context.Background(), Options{Exporter: ExporterStdout})
+	if err != nil || provider == nil {
+		t.Fatalf("expected a stdout provider, got %v %v", provider, err)
+	}
+	provider.Shutdown(context.Background())
+}
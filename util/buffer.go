@@ -0,0 +1,82 @@
+package util
+
+import "sync"
+
+const MiB = 1024 * 1024
+
+const (
+	// Smallest and largest pooled buffers, sizes in between double at each class
+	DefaultMinBufferSize = 1 * MiB
+	DefaultMaxBufferSize = 256 * MiB
+)
+
+// Shared by the image and audio workers
+var DefaultBufferPool = NewBufferPool(DefaultMinBufferSize, DefaultMaxBufferSize)
+
+/*
+Size-classed pool of byte slices, so the workers stop allocating (and the GC
+stop clearing) a large buffer for every job. A buffer is taken from the
+smallest class that fits the requested size, sizes above the largest class
+are allocated on demand and never pooled.
+The content of a buffer is not cleared, it must be fully overwritten or
+sliced to what was written.
+*/
+type BufferPool struct {
+	classes []int
+	pools   []sync.Pool
+}
+
+func NewBufferPool(minSize, maxSize int) *BufferPool {
+	var classes []int
+	for size := minSize; size <= maxSize; size *= 2 {
+		classes = append(classes, size)
+	}
+	return &BufferPool{
+		classes: classes,
+		pools:   make([]sync.Pool, len(classes)),
+	}
+}
+
+// Index of the smallest class holding size bytes, -1 when size is too large
+func (b *BufferPool) class(size int) int {
+	for i, classSize := range b.classes {
+		if size <= classSize {
+			return i
+		}
+	}
+	return -1
+}
+
+// Buffer of at least size bytes, its length is the size of its class
+func (b *BufferPool) Get(size int) []byte {
+	i := b.class(size)
+	if i == -1 {
+		return make([]byte, size)
+	}
+	if buf, ok := b.pools[i].Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, b.classes[i])
+}
+
+// Give back a buffer obtained from Get, buffers not matching a class are dropped
+func (b *BufferPool) Put(buf []byte) {
+	i := b.class(cap(buf))
+	if i == -1 || b.classes[i] != cap(buf) {
+		return
+	}
+	buf = buf[:cap(buf)]
+	b.pools[i].Put(&buf)
+}
+
+// Size of the class above the one holding size, false when there is none
+func (b *BufferPool) Grow(size int) (int, bool) {
+	i := b.class(size)
+	if i == -1 || i+1 == len(b.classes) {
+		return 0, false
+	}
+	if b.classes[i] > size {
+		return b.classes[i], true
+	}
+	return b.classes[i+1], true
+}
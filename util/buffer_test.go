@@ -0,0 +1,49 @@
+package util
+
+import "testing"
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(1024, 8192)
+
+	buf := pool.Get(1500)
+	if len(buf) != 2048 {
+		t.Fatalf("expected the 2048 class, got %d", len(buf))
+	}
+	buf[0] = 42
+	pool.Put(buf)
+
+	if large := pool.Get(10000); len(large) != 10000 {
+		t.Fatalf("expected an unpooled buffer of 10000 bytes, got %d", len(large))
+	}
+
+	if next, ok := pool.Grow(2048); !ok || next != 4096 {
+		t.Fatalf("expected to grow to 4096, got %d %v", next, ok)
+	}
+	if next, ok := pool.Grow(1500); !ok || next != 2048 {
+		t.Fatalf("expected to grow to 2048, got %d %v", next, ok)
+	}
+	if _, ok := pool.Grow(8192); ok {
+		t.Fatal("the largest class can't grow")
+	}
+}
+
+func BenchmarkBufferAlloc(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := make([]byte, 8*MiB)
+			buf[0] = 1
+		}
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := DefaultBufferPool.Get(8 * MiB)
+			buf[0] = 1
+			DefaultBufferPool.Put(buf)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package util
+
+import "net/http"
+
+// Machine-readable codes of the error responses, the apps switch on them rather than on the message
+const (
+	ErrCodeBadRequest   = "BAD_REQUEST"
+	ErrCodeUnauthorized = "UNAUTHORIZED"
+	ErrCodeForbidden    = "FORBIDDEN"
+	ErrCodeNotFound     = "NOT_FOUND"
+	ErrCodeInternal     = "INTERNAL_ERROR"
+
+	// Upload rejections
+	ErrCodeFileMissing        = "FILE_MISSING"
+	ErrCodeFileTooLarge       = "FILE_TOO_LARGE"
+	ErrCodeUnsupportedFormat  = "UNSUPPORTED_FORMAT"
+	ErrCodeFileInfected       = "FILE_INFECTED"
+	ErrCodeImageDecodeFailed  = "IMAGE_DECODE_FAILED"
+	ErrCodeImageTooLarge      = "IMAGE_TOO_LARGE"
+	ErrCodeImageTooManyFrames = "IMAGE_TOO_MANY_FRAMES"
+	ErrCodeImageMemoryLimit   = "IMAGE_MEMORY_LIMIT"
+	ErrCodePresetNotAllowed   = "PRESET_NOT_ALLOWED"
+
+	// Temporary conditions, the request can be retried
+	ErrCodeRateLimited    = "RATE_LIMITED"
+	ErrCodeTooManyUploads = "TOO_MANY_UPLOADS"
+	ErrCodeQueueFull      = "QUEUE_FULL"
+	ErrCodeShuttingDown   = "SHUTTING_DOWN"
+	ErrCodeScanFailed     = "SCAN_FAILED"
+
+	// Processing failures
+	ErrCodeTransformFailed   = "TRANSFORM_FAILED"
+	ErrCodeTransformTimedOut = "TRANSFORM_TIMED_OUT"
+	ErrCodeStorageFailed     = "STORAGE_FAILED"
+
+	ErrCodeJobNotFound      = "JOB_NOT_FOUND"
+	ErrCodeUnknownProcessor = "UNKNOWN_PROCESSOR"
+)
+
+// Http status and message of an error code, the message is safe to show to the end users
+type ErrorCode struct {
+	Status  int
+	Message string
+}
+
+var ErrorCatalog = map[string]ErrorCode{
+	ErrCodeBadRequest:   {http.StatusBadRequest, "bad request"},
+	ErrCodeUnauthorized: {http.StatusUnauthorized, "unauthorized"},
+	ErrCodeForbidden:    {http.StatusForbidden, "forbidden"},
+	ErrCodeNotFound:     {http.StatusNotFound, "not found"},
+	ErrCodeInternal:     {http.StatusInternalServerError, "internal router error"},
+
+	ErrCodeFileMissing:        {http.StatusBadRequest, "no file was uploaded"},
+	ErrCodeFileTooLarge:       {http.StatusRequestEntityTooLarge, "file is too large"},
+	ErrCodeUnsupportedFormat:  {http.StatusUnsupportedMediaType, "file format is not supported"},
+	ErrCodeFileInfected:       {http.StatusUnprocessableEntity, "file rejected by the malware scanner"},
+	ErrCodeImageDecodeFailed:  {http.StatusBadRequest, "image cannot be decoded"},
+	ErrCodeImageTooLarge:      {http.StatusRequestEntityTooLarge, "image has too many pixels"},
+	ErrCodeImageTooManyFrames: {http.StatusUnprocessableEntity, "image has too many frames"},
+	ErrCodeImageMemoryLimit:   {http.StatusRequestEntityTooLarge, "image needs too much memory to be processed"},
+	ErrCodePresetNotAllowed:   {http.StatusForbidden, "image preset is not allowed"},
+
+	ErrCodeRateLimited:    {http.StatusTooManyRequests, "rate limit exceeded, retry later"},
+	ErrCodeTooManyUploads: {http.StatusTooManyRequests, "too many uploads in progress, retry later"},
+	ErrCodeQueueFull:      {http.StatusServiceUnavailable, "processor queue is full, retry later"},
+	ErrCodeShuttingDown:   {http.StatusServiceUnavailable, "server is shutting down, retry later"},
+	ErrCodeScanFailed:     {http.StatusServiceUnavailable, "file cannot be scanned, retry later"},
+
+	ErrCodeTransformFailed:   {http.StatusUnprocessableEntity, "file cannot be processed"},
+	ErrCodeTransformTimedOut: {http.StatusGatewayTimeout, "file took too long to be processed"},
+	ErrCodeStorageFailed:     {http.StatusBadGateway, "file cannot be stored, retry later"},
+
+	ErrCodeJobNotFound:      {http.StatusNotFound, "job not found"},
+	ErrCodeUnknownProcessor: {http.StatusNotFound, "unknown processor"},
+}
+
+// Code of the generic errors, used when the caller only knows the status
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusInternalServerError:
+		return ErrCodeInternal
+	}
+	return ""
+}
+
+/*
+Write the catalog status and message of code, the error is only logged.
+Codes missing from the catalog are internal errors.
+*/
+func WriteErrorResponse(w http.ResponseWriter, code string, err error) {
+	entry, ok := ErrorCatalog[code]
+	if !ok {
+		code, entry = ErrCodeInternal, ErrorCatalog[ErrCodeInternal]
+	}
+	WriteJsonCodedErrorResponse(w, entry.Status, code, entry.Message, err)
+}
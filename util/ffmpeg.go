@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aperture147/mediaproxy/metrics"
+	"github.com/aperture147/mediaproxy/tracing"
 	"os/exec"
 	"time"
 )
@@ -15,6 +17,12 @@ const (
 )
 
 var ffmpegPath = DefaultFFmpegPath
+
+// Use another ffmpeg binary, e.g. one which isn't in the PATH
+func SetFFmpegPath(path string) {
+	ffmpegPath = path
+}
+
 var ffmpegArgs = []string{
 	"-y",                                 // Yes to all
 	"-hide_banner", "-loglevel", "panic", // Hide logs
@@ -28,52 +36,55 @@ var ffmpegArgs = []string{
 }
 
 var (
-	ErrConvertError = errors.New("cannot convert audio file")
+	ErrConvertError      = errors.New("cannot convert audio file")
+	ErrFFmpegUnavailable = errors.New("ffmpeg unavailable")
 )
 
 func GenerateError(err error) error {
-	return fmt.Errorf("convert: %v", fmt.Errorf("%v: %v", ErrConvertError, err))
+	return fmt.Errorf("convert: %w", fmt.Errorf("%v: %w", ErrConvertError, err))
 }
 
 /*
 This is a simple CLI ffmpeg wrapper. I know it's better to use cgo and libavcodec
 but I don't have much time and experience to work with both cgo and libavcodec.
 Check this for further explanation about what this piece of code do: http://bit.ly/3t6PSrZ
+ffmpeg is killed as soon as ctx is done or after DefaultDownSampleTimeout.
 */
-func AudioDownSampleToMp3(buf *[]byte, allocMemSize int) (*[]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultDownSampleTimeout)
+func AudioDownSampleToMp3(parentCtx context.Context, buf *[]byte, allocMemSize int) (*[]byte, error) {
+	ctx, span := tracing.Start(parentCtx, "ffmpeg")
+	ctx, cancel := context.WithTimeout(ctx, DefaultDownSampleTimeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, ffmpegPath, ffmpegArgs...)
 
-	resultBuffer := bytes.NewBuffer(make([]byte, allocMemSize*1024*1024))
+	// the pooled buffer is only the initial capacity, bytes.Buffer writes from its length
+	pooled := DefaultBufferPool.Get(allocMemSize * MiB)
+	defer DefaultBufferPool.Put(pooled)
+	resultBuffer := bytes.NewBuffer(pooled[:0])
 	cmd.Stdout = resultBuffer
+	cmd.Stdin = bytes.NewReader(*buf) // pump audio data to stdin pipe
 
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, GenerateError(err)
+	start := time.Now()
+	err := cmd.Run()
+	// the process error is only "signal: killed" when ffmpeg was stopped by the context
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
-
-	err = cmd.Start()
+	metrics.ObserveFFmpeg(start, err)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, GenerateError(err)
 	}
 
-	_, err = stdin.Write(*buf) // pump audio data to stdin pipe
-	if err != nil {
-		return nil, GenerateError(err)
-	}
+	// the output may still live in the pooled buffer
+	result := append([]byte(nil), resultBuffer.Bytes()...)
 
-	err = stdin.Close()
-	if err != nil {
-		return nil, GenerateError(err)
-	}
+	return &result, nil
+}
 
-	<-ctx.Done()
-	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return nil, err
+// Check ffmpeg is installed and runs, for the readiness probe
+func CheckFFmpeg(ctx context.Context) error {
+	if err := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-version").Run(); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrFFmpegUnavailable, ffmpegPath, err)
 	}
-
-	result := resultBuffer.Bytes()
-
-	return &result, nil
+	return nil
 }
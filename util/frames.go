@@ -0,0 +1,104 @@
+package util
+
+import "encoding/binary"
+
+/*
+CountFrames walks the container structure of animated formats (gif, apng and webp)
+and returns the format and its number of frames without decoding any pixel.
+Formats which can't be animated are reported as a single frame with an empty format.
+Truncated files return the frames counted so far, the decoder rejects them anyway.
+*/
+func CountFrames(buf []byte) (string, int) {
+	switch format := SniffFormat(buf); format {
+	case FormatGif:
+		return format, countGifFrames(buf)
+	case FormatPng:
+		return format, countPngFrames(buf)
+	case FormatWebp:
+		return format, countWebpFrames(buf)
+	}
+	return "", 1
+}
+
+// Skip a chain of gif data sub-blocks, returns the offset right after the terminator
+func skipGifSubBlocks(buf []byte, offset int) int {
+	for offset < len(buf) {
+		size := int(buf[offset])
+		offset++
+		if size == 0 {
+			return offset
+		}
+		offset += size
+	}
+	return offset
+}
+
+func countGifFrames(buf []byte) int {
+	// header (6) + logical screen descriptor (7)
+	offset := 13
+	if len(buf) < offset {
+		return 0
+	}
+	if flags := buf[10]; flags&0x80 != 0 {
+		offset += 3 << ((flags & 0x07) + 1) // global color table
+	}
+
+	frames := 0
+	for offset < len(buf) {
+		switch buf[offset] {
+		case 0x21: // extension: introducer, label, sub-blocks
+			offset = skipGifSubBlocks(buf, offset+2)
+		case 0x2c: // image descriptor
+			if offset+10 > len(buf) {
+				return frames
+			}
+			frames++
+			flags := buf[offset+9]
+			offset += 10
+			if flags&0x80 != 0 {
+				offset += 3 << ((flags & 0x07) + 1) // local color table
+			}
+			offset = skipGifSubBlocks(buf, offset+1) // LZW minimum code size then data
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// Animated png carries the frame count in its acTL chunk
+func countPngFrames(buf []byte) int {
+	offset := len(pngMagic)
+	for offset+8 <= len(buf) {
+		length := int(binary.BigEndian.Uint32(buf[offset:]))
+		chunkType := string(buf[offset+4 : offset+8])
+		if chunkType == "acTL" && offset+12 <= len(buf) {
+			return int(binary.BigEndian.Uint32(buf[offset+8:]))
+		}
+		if chunkType == "IDAT" || length < 0 {
+			break // acTL must come before the image data
+		}
+		offset += 12 + length // length, type, data, crc
+	}
+	return 1
+}
+
+// Animated webp stores one ANMF chunk per frame
+func countWebpFrames(buf []byte) int {
+	frames := 0
+	offset := 12
+	for offset+8 <= len(buf) {
+		size := int(binary.LittleEndian.Uint32(buf[offset+4:]))
+		if string(buf[offset:offset+4]) == "ANMF" {
+			frames++
+		}
+		if size < 0 {
+			break
+		}
+		offset += 8 + size + size&1 // chunks are padded to an even size
+	}
+	if frames == 0 {
+		return 1
+	}
+	return frames
+}
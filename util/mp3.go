@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"time"
+)
+
+// Layer III bitrates in kbps by bitrate index, MPEG 1 then MPEG 2 and 2.5
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// Sample rates by version bits then sample rate index, version 1 is reserved
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG 2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG 2
+	{44100, 48000, 32000}, // MPEG 1
+}
+
+type Mp3Info struct {
+	Duration time.Duration
+	// Average bitrate of the audio frames, in bits per second
+	Bitrate int
+}
+
+// Length of the id3v2 tag at the start of buf, 0 when there is none
+func id3v2Length(buf []byte) int {
+	if len(buf) < 10 || !bytes.HasPrefix(buf, []byte("ID3")) {
+		return 0
+	}
+	// syncsafe integer, 7 bits per byte
+	size := int(buf[6])<<21 | int(buf[7])<<14 | int(buf[8])<<7 | int(buf[9])
+	if buf[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return 10 + size
+}
+
+// The tag sits right after the side information, 64 bytes is past it in every mode
+func isXingFrame(frame []byte) bool {
+	if len(frame) > 64 {
+		frame = frame[:64]
+	}
+	return bytes.Contains(frame, []byte("Xing")) || bytes.Contains(frame, []byte("Info"))
+}
+
+/*
+ReadMp3Info walks the layer III frame headers of an mp3 and sums their samples,
+nothing is decoded. The Xing/Info frame written by lame is not audio and is skipped.
+The walk stops at the first byte which isn't a frame header, e.g. an id3v1 tag.
+ok is false when no audio frame was found.
+*/
+func ReadMp3Info(buf []byte) (Mp3Info, bool) {
+	offset := id3v2Length(buf)
+	var seconds float64
+	audioBytes := 0
+	first := true
+	for offset+4 <= len(buf) {
+		header := buf[offset : offset+4]
+		if header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+			break
+		}
+		version := (header[1] >> 3) & 0x03
+		layer := (header[1] >> 1) & 0x03
+		bitrateIndex := header[2] >> 4
+		sampleRateIndex := (header[2] >> 2) & 0x03
+		padding := int((header[2] >> 1) & 0x01)
+		if version == 1 || layer != 1 || sampleRateIndex == 3 {
+			break
+		}
+
+		table, samples := 0, 1152
+		if version != 3 {
+			table, samples = 1, 576
+		}
+		bitrate := mp3Bitrates[table][bitrateIndex] * 1000
+		sampleRate := mp3SampleRates[version][sampleRateIndex]
+		if bitrate == 0 {
+			// free format, the frame length is unknown
+			break
+		}
+		length := samples/8*bitrate/sampleRate + padding
+		end := offset + length
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		if !(first && isXingFrame(buf[offset:end])) {
+			seconds += float64(samples) / float64(sampleRate)
+			audioBytes += end - offset
+		}
+		first = false
+		offset += length
+	}
+	if seconds == 0 {
+		return Mp3Info{}, false
+	}
+	return Mp3Info{
+		Duration: time.Duration(seconds * float64(time.Second)),
+		Bitrate:  int(float64(audioBytes*8) / seconds),
+	}, true
+}
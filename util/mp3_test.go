@@ -0,0 +1,43 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// MPEG 1 layer III frames at 128kbps and 44.1kHz, 417 bytes without padding
+func mp3Frames(n int, xing bool) []byte {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		if xing && i == 0 {
+			copy(frame[36:], "Info")
+		}
+		buf = append(buf, frame...)
+	}
+	return buf
+}
+
+func TestReadMp3Info(t *testing.T) {
+	// id3v2 tag of 20 bytes before the frames, an id3v1 tag after
+	tag := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 10}, make([]byte, 10)...)
+	buf := append(append(tag, mp3Frames(101, true)...), []byte("TAG")...)
+
+	info, ok := ReadMp3Info(buf)
+	if !ok {
+		t.Fatal("no frame found")
+	}
+	// the info frame is not audio
+	expected := 100 * 1152 * time.Second / 44100
+	if diff := info.Duration - expected; diff > time.Millisecond || diff < -time.Millisecond {
+		t.Errorf("expected %v, got %v", expected, info.Duration)
+	}
+	if info.Bitrate < 127000 || info.Bitrate > 128000 {
+		t.Errorf("expected about 128kbps, got %d", info.Bitrate)
+	}
+
+	if _, ok = ReadMp3Info([]byte("not an mp3 at all")); ok {
+		t.Error("expected no frame")
+	}
+}
@@ -2,35 +2,56 @@ package util
 
 import (
 	"encoding/json"
-	"fmt"
+	"github.com/aperture147/mediaproxy/logging"
 	"net/http"
 )
 
 type Response struct {
 	Status  int         `json:"status"`
-	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"` // machine-readable error code, see ErrorCatalog
+	Message string      `json:"message"`        // safe to show to the end users
 	Data    interface{} `json:"data"`
 }
 
+func writeResponse(w http.ResponseWriter, response Response) {
+	jsonData, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	w.Write(jsonData)
+}
+
 func WriteJsonResponse(w http.ResponseWriter, status int, message string, data interface{}) {
-	response := Response{
+	writeResponse(w, Response{
 		Status:  status,
 		Message: message,
 		Data:    data,
-	}
-
-	jsonData, _ := json.Marshal(response)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(jsonData)
+	})
 }
 
 func WriteOkResponse(w http.ResponseWriter, data interface{}) {
 	WriteJsonResponse(w, http.StatusOK, "ok", data)
 }
 
+// Error response with the generic code of the status, prefer WriteErrorResponse with a precise code
 func WriteJsonErrorResponse(w http.ResponseWriter, status int, message string, err error) {
-	WriteJsonResponse(w, status, fmt.Sprint(message), nil)
+	WriteJsonCodedErrorResponse(w, status, statusErrorCode(status), message, err)
+}
+
+// The error is logged, it's never returned to the client since it can hold internal details
+func WriteJsonCodedErrorResponse(w http.ResponseWriter, status int, code, message string, err error) {
+	if err != nil {
+		fields := logging.Fields{"status": status, "code": code}
+		if status < http.StatusInternalServerError {
+			logging.Warn(message, err, fields)
+		} else {
+			logging.Error(message, err, fields)
+		}
+	}
+	writeResponse(w, Response{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	})
 }
 
 func WriteForbiddenResponse(w http.ResponseWriter, err error) {
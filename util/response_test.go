@@ -0,0 +1,82 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/aperture147/mediaproxy/logging"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) Response {
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Capture the lines logged by the response writers
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	logging.Default.SetOutput(buf)
+	t.Cleanup(func() { logging.Default.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	cases := []struct {
+		code   string
+		err    error
+		status int
+	}{
+		{ErrCodeFileTooLarge, errors.New("request: too large"), http.StatusRequestEntityTooLarge},
+		{ErrCodeQueueFull, errors.New("image: queue full"), http.StatusServiceUnavailable},
+		{ErrCodeStorageFailed, nil, http.StatusBadGateway},
+		{"NOT_IN_CATALOG", errors.New("secret"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		logged := captureLog(t)
+		w := httptest.NewRecorder()
+		WriteErrorResponse(w, c.code, c.err)
+		response := decodeResponse(t, w)
+		if w.Code != c.status || response.Status != c.status {
+			t.Errorf("%s: expected %d, got %d", c.code, c.status, w.Code)
+		}
+		entry, ok := ErrorCatalog[response.Code]
+		if !ok || response.Message != entry.Message {
+			t.Errorf("%s: unexpected code %q and message %q", c.code, response.Code, response.Message)
+		}
+		if c.err != nil {
+			if strings.Contains(w.Body.String(), c.err.Error()) {
+				t.Errorf("%s: error leaked in %s", c.code, w.Body.String())
+			}
+			if !strings.Contains(logged.String(), c.err.Error()) {
+				t.Errorf("%s: error not logged", c.code)
+			}
+		}
+	}
+}
+
+func TestWriteJsonErrorResponseCode(t *testing.T) {
+	logged := captureLog(t)
+	w := httptest.NewRecorder()
+	WriteBadRequestResponse(w, errors.New("policy: expired"))
+	response := decodeResponse(t, w)
+	if response.Code != ErrCodeBadRequest || response.Message != "bad request" || strings.Contains(w.Body.String(), "expired") {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	WriteServerErrorResponse(w, errors.New("dial tcp 10.0.0.1:9000: refused"))
+	if response = decodeResponse(t, w); response.Code != ErrCodeInternal || strings.Contains(w.Body.String(), "10.0.0.1") {
+		t.Fatalf("server error leaked: %s", w.Body.String())
+	}
+	if !strings.Contains(logged.String(), "policy: expired") || !strings.Contains(logged.String(), "10.0.0.1") {
+		t.Fatalf("errors not logged: %s", logged.String())
+	}
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	FormatWebp = "webp"
+	FormatGif  = "gif"
+	FormatMp3  = "mp3"
+	FormatWav  = "wav"
+	FormatFlac = "flac"
+	FormatOgg  = "ogg"
+	FormatM4a  = "m4a"
+)
+
+var (
+	gifMagic87 = []byte("GIF87a")
+	gifMagic89 = []byte("GIF89a")
+	pngMagic   = []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}
+)
+
+// Mime types and file extensions a client may declare for each sniffed format
+type FormatInfo struct {
+	MimeTypes  []string
+	Extensions []string
+}
+
+var Formats = map[string]FormatInfo{
+	FormatJpeg: {[]string{"image/jpeg", "image/pjpeg"}, []string{".jpg", ".jpeg", ".jpe", ".jfif"}},
+	FormatPng:  {[]string{"image/png"}, []string{".png"}},
+	FormatWebp: {[]string{"image/webp"}, []string{".webp"}},
+	FormatGif:  {[]string{"image/gif"}, []string{".gif"}},
+	FormatMp3:  {[]string{"audio/mpeg", "audio/mp3", "audio/mpeg3", "audio/x-mpeg-3"}, []string{".mp3"}},
+	FormatWav:  {[]string{"audio/wav", "audio/x-wav", "audio/wave", "audio/vnd.wave"}, []string{".wav", ".wave"}},
+	FormatFlac: {[]string{"audio/flac", "audio/x-flac"}, []string{".flac"}},
+	FormatOgg:  {[]string{"audio/ogg", "application/ogg", "audio/vorbis", "audio/opus"}, []string{".ogg", ".oga", ".opus"}},
+	FormatM4a:  {[]string{"audio/mp4", "audio/m4a", "audio/x-m4a", "audio/aac"}, []string{".m4a", ".m4b", ".mp4", ".aac"}},
+}
+
+// Major brands of the ISO base media files accepted as m4a audio, the generic
+// ones (isom, mp42...) are mostly video and are rejected
+var m4aBrands = []string{"M4A ", "M4B ", "mp4a"}
+
+/*
+SniffFormat looks at the magic bytes and returns one of the Format constants,
+an empty string is returned when the format is unknown.
+*/
+func SniffFormat(buf []byte) string {
+	switch {
+	case len(buf) >= 3 && buf[0] == 0xff && buf[1] == 0xd8 && buf[2] == 0xff:
+		return FormatJpeg
+	case bytes.HasPrefix(buf, pngMagic):
+		return FormatPng
+	case bytes.HasPrefix(buf, gifMagic87) || bytes.HasPrefix(buf, gifMagic89):
+		return FormatGif
+	case len(buf) >= 12 && string(buf[0:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		return FormatWebp
+	case len(buf) >= 12 && string(buf[0:4]) == "RIFF" && string(buf[8:12]) == "WAVE":
+		return FormatWav
+	case bytes.HasPrefix(buf, []byte("fLaC")):
+		return FormatFlac
+	case bytes.HasPrefix(buf, []byte("OggS")):
+		return FormatOgg
+	case len(buf) >= 12 && string(buf[4:8]) == "ftyp" && isM4aBrand(string(buf[8:12])):
+		return FormatM4a
+	case bytes.HasPrefix(buf, []byte("ID3")):
+		return FormatMp3
+	case len(buf) >= 2 && buf[0] == 0xff && buf[1]&0xe0 == 0xe0 && buf[1]&0x06 != 0:
+		// mpeg audio frame sync, jpeg (ff d8) is handled above. The layer bits
+		// are never 00 there, while adts aac (ff f1, ff f9) always has them 00
+		return FormatMp3
+	}
+	return ""
+}
+
+func isM4aBrand(brand string) bool {
+	for _, b := range m4aBrands {
+		if brand == b {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// Markers of scripts or documents are only looked for at the start of the file,
+	// that's where browsers and document readers look for them too
+	polyglotHeadSize = 1024
+	// A zip archive is read from its end of central directory record,
+	// which lives in the last 64KiB + 22 bytes of the file
+	polyglotTailSize = 64*1024 + 22
+)
+
+var polyglotHeadMarkers = [][]byte{
+	[]byte("<html"),
+	[]byte("<!doctype html"),
+	[]byte("<script"),
+	[]byte("<?php"),
+	[]byte("%pdf-"),
+}
+
+var zipEndOfCentralDirectory = []byte("PK\x05\x06")
+
+/*
+IsPolyglot reports whether a file which sniffs as a media format also
+carries the structure of another format: an html/php/pdf header or a zip
+archive appended at its end (the classic GIFAR trick).
+*/
+func IsPolyglot(buf []byte) bool {
+	head := buf
+	if len(head) > polyglotHeadSize {
+		head = head[:polyglotHeadSize]
+	}
+	head = bytes.ToLower(head)
+	for _, marker := range polyglotHeadMarkers {
+		if bytes.Contains(head, marker) {
+			return true
+		}
+	}
+
+	tail := buf
+	if len(tail) > polyglotTailSize {
+		tail = tail[len(tail)-polyglotTailSize:]
+	}
+	return bytes.Contains(tail, zipEndOfCentralDirectory)
+}
+
+// Check whether the declared mime type matches the format, parameters like charset are ignored
+func MatchesMimeType(format, mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	for _, m := range Formats[format].MimeTypes {
+		if m == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the file name extension matches the format
+func MatchesExtension(format, fileName string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, e := range Formats[format].Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package util
+
+import "testing"
+
+func TestSniffFormatMpegAudio(t *testing.T) {
+	cases := []struct {
+		name   string
+		buf    []byte
+		format string
+	}{
+		{"mp3 frame", []byte{0xff, 0xfb, 0x90, 0x64, 0x00}, FormatMp3},
+		{"mpeg 2 layer iii", []byte{0xff, 0xf3, 0x48, 0xc4, 0x00}, FormatMp3},
+		{"id3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), FormatMp3},
+		{"adts aac mpeg-4", []byte{0xff, 0xf1, 0x50, 0x80, 0x02, 0x1f, 0xfc}, ""},
+		{"adts aac mpeg-2", []byte{0xff, 0xf9, 0x50, 0x80, 0x02, 0x1f, 0xfc}, ""},
+	}
+	for _, c := range cases {
+		if format := SniffFormat(c.buf); format != c.format {
+			t.Errorf("%s: expected %q, got %q", c.name, c.format, format)
+		}
+	}
+}
+
+func TestSniffFormatM4a(t *testing.T) {
+	ftyp := func(major string, compatible ...string) []byte {
+		box := append([]byte{0, 0, 0, byte(16 + 4*len(compatible))}, "ftyp"+major+"\x00\x00\x02\x00"...)
+		for _, brand := range compatible {
+			box = append(box, brand...)
+		}
+		return box
+	}
+	cases := []struct {
+		name   string
+		buf    []byte
+		format string
+	}{
+		{"m4a", ftyp("M4A ", "M4A ", "isom", "iso2"), FormatM4a},
+		{"audio book", ftyp("M4B ", "M4B ", "isom"), FormatM4a},
+		{"mp4 video", ftyp("isom", "isom", "iso2", "avc1", "mp41"), ""},
+		{"mp42 video", ftyp("mp42", "mp42", "avc1"), ""},
+	}
+	for _, c := range cases {
+		if format := SniffFormat(c.buf); format != c.format {
+			t.Errorf("%s: expected %q, got %q", c.name, c.format, format)
+		}
+	}
+}
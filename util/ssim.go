@@ -0,0 +1,99 @@
+package util
+
+import (
+	"errors"
+	"image"
+)
+
+const (
+	// Window size used by the SSIM computation, 8x8 is the common choice
+	// when we only care about a single score for the whole image
+	ssimWindow = 8
+
+	// Stabilizing constants from the original SSIM paper, L = 255
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+var ErrSsimSizeMismatch = errors.New("images have different sizes")
+
+// Convert an image to its luma plane, SSIM is computed on luma only since
+// the human eye is way more sensitive to brightness than to color
+func luma(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	plane := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			// BT.601 luma, RGBA() returns 16 bits per channel
+			plane[y*width+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+	return plane, width, height
+}
+
+/*
+SSIM computes the mean structural similarity index between two images of the
+same size. The result is in [-1, 1], 1 means both images are identical.
+This is a plain windowed implementation without gaussian weighting, it's
+good enough to compare an encoded image against its own source.
+*/
+func SSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
+		return 0, ErrSsimSizeMismatch
+	}
+	planeA, width, height := luma(a)
+	planeB, _, _ := luma(b)
+
+	window := ssimWindow
+	if width < window || height < window {
+		// tiny image, use the whole image as a single window
+		window = width
+		if height < window {
+			window = height
+		}
+	}
+	if window == 0 {
+		return 0, ErrSsimSizeMismatch
+	}
+
+	total, count := 0.0, 0
+	for y := 0; y+window <= height; y += window {
+		for x := 0; x+window <= width; x += window {
+			total += ssimWindowScore(planeA, planeB, width, x, y, window)
+			count++
+		}
+	}
+	return total / float64(count), nil
+}
+
+func ssimWindowScore(a, b []float64, stride, x0, y0, window int) float64 {
+	n := float64(window * window)
+	var sumA, sumB float64
+	for y := y0; y < y0+window; y++ {
+		for x := x0; x < x0+window; x++ {
+			sumA += a[y*stride+x]
+			sumB += b[y*stride+x]
+		}
+	}
+	meanA, meanB := sumA/n, sumB/n
+
+	var varA, varB, covar float64
+	for y := y0; y < y0+window; y++ {
+		for x := x0; x < x0+window; x++ {
+			da, db := a[y*stride+x]-meanA, b[y*stride+x]-meanB
+			varA += da * da
+			varB += db * db
+			covar += da * db
+		}
+	}
+	denominator := n - 1
+	if denominator < 1 {
+		denominator = 1
+	}
+	varA, varB, covar = varA/denominator, varB/denominator, covar/denominator
+
+	return ((2*meanA*meanB + ssimC1) * (2*covar + ssimC2)) /
+		((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+}
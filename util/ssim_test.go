@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// Smooth gradient with some texture, a stand-in for a photo
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8((x ^ y) * 8), 255})
+		}
+	}
+	return img
+}
+
+func jpegRoundTrip(t *testing.T, img image.Image, quality int) image.Image {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestSSIM(t *testing.T) {
+	source := gradient(64, 64)
+	cases := []struct {
+		name     string
+		a, b     image.Image
+		min, max float64
+		err      error
+	}{
+		{"identical", source, source, 1, 1, nil},
+		{"light jpeg", source, jpegRoundTrip(t, source, 95), 0.9, 1, nil},
+		{"heavy jpeg", source, jpegRoundTrip(t, source, 5), 0, 0.9, nil},
+		// smaller than a window, the whole image is one window
+		{"tiny identical", gradient(4, 6), gradient(4, 6), 1, 1, nil},
+		{"size mismatch", source, gradient(32, 64), 0, 0, ErrSsimSizeMismatch},
+		{"empty", image.NewRGBA(image.Rect(0, 0, 0, 0)), image.NewRGBA(image.Rect(0, 0, 0, 0)), 0, 0, ErrSsimSizeMismatch},
+	}
+	for _, c := range cases {
+		score, err := SSIM(c.a, c.b)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if err == nil && (score < c.min-1e-9 || score > c.max+1e-9 || math.IsNaN(score)) {
+			t.Errorf("%s: score %f out of [%f, %f]", c.name, score, c.min, c.max)
+		}
+	}
+
+	light, _ := SSIM(source, jpegRoundTrip(t, source, 95))
+	heavy, _ := SSIM(source, jpegRoundTrip(t, source, 5))
+	if heavy >= light {
+		t.Errorf("a heavier degradation scored higher: %f >= %f", heavy, light)
+	}
+}